@@ -1,14 +1,23 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"math"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/atotto/clipboard"
 	"github.com/gdamore/tcell/v2"
@@ -16,8 +25,30 @@ import (
 	"gopkg.in/yaml.v3"
 )
 
+// Kinds of components of the command being built. The "--" separator is
+// inserted automatically and can't be deleted on its own.
 const (
-	SPEC_VERSION = "1.0.0"
+	COMPONENT_WRAPPER = iota
+	COMPONENT_ENVVAR
+	COMPONENT_COMMAND
+	COMPONENT_VALUE
+	COMPONENT_SEPARATOR
+)
+
+const (
+	SPEC_VERSION   = "1.1.0"
+	SPEC_EXTENSION = ".cmd.yaml"
+	SPEC_PATH_ENV  = "BRIEF_PATH"
+	CONFIG_FILE    = "config.yaml"
+	TRUST_FILE     = "trusted.yaml"
+
+	MIGRATE_COMMAND = "migrate"
+
+	EXTENSION_PREFIX       = "x-"
+	BRIEF_EXTENSION_PREFIX = "x-brief-"
+
+	DEFAULT_VERSION_PATTERN = `\d+(\.\d+)+`
+	VERSION_TIMEOUT         = 5 * time.Second
 
 	LETTERS       = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
 	DIGITS        = "0987654321"
@@ -28,16 +59,52 @@ const (
 	FLAG_TYPE_VALUE          = "value"
 	FLAG_TYPE_VALUE_OPTIONAL = "valueOptional"
 	FLAG_TYPE_TOGGLE         = "toggle"
+	FLAG_TYPE_COUNT          = "count"
+
+	ARGUMENT_TYPE_REST = "rest"
+
+	NARGS_OPTIONAL = "?"
+	NARGS_ANY      = "*"
+	NARGS_SOME     = "+"
+
+	COUNT_STYLE_CLUSTERED = "clustered"
+	COUNT_STYLE_REPEATED  = "repeated"
+
+	VALUE_TYPE_STRING   = "string"
+	VALUE_TYPE_INT      = "int"
+	VALUE_TYPE_FLOAT    = "float"
+	VALUE_TYPE_ENUM     = "enum"
+	VALUE_TYPE_PATH     = "path"
+	VALUE_TYPE_DURATION = "duration"
+	VALUE_TYPE_URL      = "url"
+	VALUE_TYPE_REGEX    = "regex"
 
 	QUOTING_SINGLE = "single"
 	QUOTING_DOUBLE = "double"
 
-	ENVVAR_KEY = '!'
-	HELP_KEY   = '?'
-	CANCEL_KEY = tcell.KeyCtrlG
+	ENVVAR_KEY   = '!'
+	WRAPPER_KEY  = '^'
+	HELP_KEY     = '?'
+	FILTER_KEY   = '/'
+	GROUP_KEY    = '#'
+	NEGATIVE_KEY = '_'
+	CANCEL_KEY   = tcell.KeyCtrlG
+	SEARCH_KEY   = tcell.KeyCtrlS
+	SHOW_ALL_KEY = tcell.KeyCtrlT
+	EDIT_KEY     = tcell.KeyCtrlE
+	MISSING_KEY  = tcell.KeyTab
 
 	MAX_COMPLETIONS = 40
 
+	DOUBLE_DASH = "--"
+
+	ENVVAR_NAME_PATTERN = "^[A-Za-z_][A-Za-z0-9_]*$"
+
+	DEFAULT_DELIMITER = ","
+	SECRET_MASK       = "****"
+	SELECTED_MARK     = "✓ "
+	UNSELECTED_MARK   = "  "
+
 	KEY_COLOR    = "deeppink"
 	ARG_ON_COLOR = "orange"
 )
@@ -51,9 +118,49 @@ type option struct {
 	// Syntactic properties of the option itself
 	FlagType   string `yaml:"type"`
 	Repeatable bool   `yaml:"repeatable"`
+	Nargs      string `yaml:"nargs"`
+	Position   int    `yaml:"position"`
 	Separator  string `yaml:"separator"`
 	Quoting    string `yaml:"quoting"`
 
+	// Arguments that must come after the end-of-options separator (--)
+	AfterDoubleDash bool `yaml:"afterDoubleDash"`
+
+	// Arguments that are a whole other command (e.g. for sudo), which is
+	// built in a nested brief session
+	Command bool `yaml:"command"`
+
+	// Toggles can be negatable, i.e. cycle between --foo and --no-foo.
+	// The negated form of the flag can be set with negation.
+	Negatable bool   `yaml:"negatable"`
+	Negation  string `yaml:"negation"`
+
+	// How count flags are rendered: clustered (-vvv) or repeated
+	// (-v -v -v)
+	CountStyle string `yaml:"countStyle"`
+
+	// The type of the option's values, and constraints on them
+	ValueType string   `yaml:"valueType"`
+	Min       *float64 `yaml:"min"`
+	Max       *float64 `yaml:"max"`
+	Pattern   string   `yaml:"pattern"`
+	Choices   []string `yaml:"choices"`
+
+	// List options take multiple values, joined by a delimiter into a
+	// single token (e.g. --cap-add=A,B)
+	List      bool   `yaml:"list"`
+	Delimiter string `yaml:"delimiter"`
+
+	// How many times the option must (or may) be present. Setting
+	// required is the same as setting minOccurs to 1.
+	Required  bool `yaml:"required"`
+	MinOccurs int  `yaml:"minOccurs"`
+	MaxOccurs int  `yaml:"maxOccurs"`
+
+	// Relations to other options, referenced by flag or argument name
+	Conflicts []string `yaml:"conflicts"`
+	Requires  []string `yaml:"requires"`
+
 	// Properties to make querying for a value easier/quicker
 	Default     string           `yaml:"default"`
 	Placeholder string           `yaml:"placeholder"`
@@ -62,12 +169,42 @@ type option struct {
 
 	// A description of the option
 	Help string `yaml:"help"`
+	// A longer description, which can span several lines
+	Description string `yaml:"description"`
+	// The name of the group the option is shown in, if any
+	Group string `yaml:"group"`
+
+	// Status of the option in the command: hidden options are only shown
+	// when asked for, and deprecated ones explain what to use instead
+	Hidden       bool   `yaml:"hidden"`
+	Deprecated   string `yaml:"deprecated"`
+	Experimental bool   `yaml:"experimental"`
+
+	// Versions of the command in which the option is available: from
+	// since, and before until
+	Since string `yaml:"since"`
+	Until string `yaml:"until"`
+
+	// Vendor extensions (see the extensions type)
+	Extensions extensions `yaml:"-"`
 
 	// Runtime variables
 	key    rune
 	prefix rune
 }
 
+// extensions contains the properties of a spec element starting with
+// "x-", which other tools can use to store their own data. brief's own
+// hints are read from the ones starting with "x-brief-".
+type extensions map[string]any
+
+// brief returns the value of the x-brief- property called name, if it is
+// a string.
+func (ext extensions) brief(name string) string {
+	value, _ := ext[BRIEF_EXTENSION_PREFIX+name].(string)
+	return value
+}
+
 type optionCompletion struct {
 	Values []string `yaml:"values"`
 	Cmd    []string `yaml:"command"`
@@ -84,46 +221,391 @@ type optionValue struct {
 	// the completed version of the flag. Otherwise, it
 	// contains the empty string.
 	flag string
+	// If this optionValue corresponds to a command argument, the nested
+	// session in which the command was built.
+	nested *application
+}
+
+func (val *optionValue) flagText() string {
+	if val.flag != "" {
+		return val.flag
+	}
+	return val.opt.mainFlag()
+}
+
+// render returns the text for the value as it should appear in the
+// command.
+func (val *optionValue) render() string {
+	opt := val.opt
+	valuePreview := val.value
+
+	if opt.isVerbatim() {
+		// Rest and command arguments contain everything remaining in the
+		// command, already split and quoted.
+		return valuePreview
+	}
+
+	if opt.Quoting == QUOTING_SINGLE {
+		valuePreview = "'" + valuePreview + "'"
+	} else if opt.Quoting == QUOTING_DOUBLE {
+		valuePreview = "\"" + valuePreview + "\""
+	} else if valuePreview == "" {
+		// Quote empty values using double quotes, by default
+		valuePreview = "\"\""
+	}
+
+	if !opt.isFlag() {
+		return valuePreview
+	}
+
+	flagText := val.flagText()
+
+	if opt.isCount() {
+		n, _ := strconv.Atoi(val.value)
+		return opt.countFlag(flagText, n)
+	} else if opt.FlagType == FLAG_TYPE_TOGGLE ||
+		(opt.FlagType == FLAG_TYPE_VALUE_OPTIONAL && val.value == "") ||
+		(opt.isChoice() && opt.isTemplate()) {
+		// Choice options with template flags (e.g. --http<version>)
+		// already contain the value in the flag itself.
+		return flagText
+	}
+
+	sep := " "
+	if opt.Separator != "" {
+		sep = opt.Separator
+	}
+	return flagText + sep + valuePreview
+}
+
+// clusterable reports whether the value is a short flag (like -x) that
+// can be merged with other short flags into a single token.
+func (val *optionValue) clusterable() bool {
+	opt := val.opt
+	if !opt.isFlag() || opt.isTemplate() {
+		return false
+	}
+
+	flag := val.flagText()
+	if len(flag) != 2 || !isPrefix(rune(flag[0])) || isPrefix(rune(flag[1])) {
+		return false
+	}
+
+	switch opt.getType() {
+	case FLAG_TYPE_TOGGLE:
+		return true
+	case FLAG_TYPE_COUNT:
+		return opt.CountStyle != COUNT_STYLE_REPEATED
+	case FLAG_TYPE_VALUE:
+		return opt.Separator == "" || opt.Separator == " "
+	}
+	return false
+}
+
+// needsDoubleDash reports whether the value must be preceded by the "--"
+// separator: either because the argument requires it, or because its
+// value would otherwise be mistaken for a flag.
+func (val *optionValue) needsDoubleDash() bool {
+	opt := val.opt
+	if !opt.isArgument() {
+		return false
+	}
+	return opt.AfterDoubleDash || (!opt.isVerbatim() && strings.HasPrefix(val.value, "-"))
+}
+
+// component is one of the parts of the command shown in the preview,
+// which the cursor can move through.
+type component struct {
+	kind int
+	// Index in app.wrappers or app.environment, for wrappers and
+	// environment variables
+	index int
+	// The command the component belongs to, for command names, option
+	// values and separators
+	cmd *subcommand
+	// The option value, for option values
+	val *optionValue
 }
 
 type subcommand struct {
 	Name        string        `yaml:"name"`
+	Aliases     []string      `yaml:"aliases"`
 	Subcommands []*subcommand `yaml:"subcommands"`
 	Options     []*option     `yaml:"options"`
 	Help        string        `yaml:"help"`
+	Description string        `yaml:"description"`
+	Groups      []*group      `yaml:"groups"`
+
+	// Whether short toggle flags are merged (-xzvf), when set
+	ClusterShortFlags *bool `yaml:"clusterShortFlags"`
+
+	// Same as for options
+	Hidden       bool   `yaml:"hidden"`
+	Deprecated   string `yaml:"deprecated"`
+	Experimental bool   `yaml:"experimental"`
+	Since        string `yaml:"since"`
+	Until        string `yaml:"until"`
+
+	Extensions extensions `yaml:"-"`
 
 	key       rune
 	optValues []*optionValue
 }
 
+// group is a section of a command's options, shown under its own
+// heading. Groups can be collapsed to hide their options. Groups with a
+// key are menus instead: their options are only shown (and given keys)
+// after pressing the menu's key.
+type group struct {
+	Name      string `yaml:"name"`
+	Help      string `yaml:"help"`
+	Collapsed bool   `yaml:"collapsed"`
+	Key       string `yaml:"key"`
+
+	key     rune
+	toggled bool
+}
+
+func (g *group) isCollapsed() bool {
+	return g.isMenu() || g.Collapsed != g.toggled
+}
+
+func (g *group) isMenu() bool {
+	return g.Key != ""
+}
+
+func (g *group) menuKey() rune {
+	return []rune(g.Key)[0]
+}
+
+// optionSection contains the options shown under the same heading. The
+// options without a group are in a section without one.
+type optionSection struct {
+	group   *group
+	options []*option
+}
+
 type command struct {
 	Name        string        `yaml:"name"`
 	Version     string        `yaml:"version"`
 	Subcommands []*subcommand `yaml:"subcommands"`
 	Options     []*option     `yaml:"options"`
 	Help        string        `yaml:"help"`
+	Description string        `yaml:"description"`
+	Groups      []*group      `yaml:"groups"`
+
+	ClusterShortFlags *bool `yaml:"clusterShortFlags"`
+
+	// Environment variables the command reads, which can be set with
+	// their own keys
+	Environment []*envDecl `yaml:"environment"`
+
+	// A command that prints the installed version of the command, and a
+	// pattern to find the version in its output. The first group of the
+	// pattern is used as the version, if it has one.
+	VersionCommand []string `yaml:"versionCommand"`
+	VersionPattern string   `yaml:"versionPattern"`
+
+	Extensions extensions `yaml:"-"`
+}
+
+// envDecl is an environment variable declared in the spec.
+type envDecl struct {
+	Name       string           `yaml:"name"`
+	Help       string           `yaml:"help"`
+	Completion optionCompletion `yaml:"completion"`
+	// Secret values are masked in the preview, and are not completed
+	// from the current environment
+	Secret bool `yaml:"secret"`
+
+	key rune
+}
+
+// envvar is an environment variable set (or unset) for the command being
+// built.
+type envvar struct {
+	name  string
+	value string
+	unset bool
+	// The spec's declaration of the variable, if any
+	decl *envDecl
+}
+
+func (ev *envvar) isSecret() bool {
+	return ev.decl != nil && ev.decl.Secret
+}
+
+// render returns the variable as a shell assignment, or as an -u option
+// for env when it is unset.
+func (ev *envvar) render(masked bool) string {
+	if ev.unset {
+		return "-u " + ev.name
+	}
+
+	value := ev.value
+	if masked && ev.isSecret() {
+		value = SECRET_MASK
+	} else if value == "" || strings.ContainsAny(value, " \t\n\"'$`\\") {
+		value = "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+	}
+	return ev.name + "=" + value
 }
 
 type spec struct {
 	Version string  `yaml:"specVersion"`
 	Command command `yaml:"command"`
+
+	Extensions extensions `yaml:"-"`
+
+	// Problems found while loading the spec, which are shown when it is
+	// opened
+	warnings []string
+}
+
+// wrapper is a command that can be put in front of the command being
+// built, like sudo or nice -n 10. Wrappers are defined in the user's
+// config.
+type wrapper struct {
+	Name string   `yaml:"name"`
+	Args []string `yaml:"args"`
+	Help string   `yaml:"help"`
+	Key  string   `yaml:"key"`
+	// An optional value to prompt for, which is placed after args
+	Value *option `yaml:"value"`
+	// Whether environment variable assignments (VAR=value) can be placed
+	// right after the wrapper, like with sudo. Otherwise, they are passed
+	// to env instead.
+	Assignments bool `yaml:"assignments"`
+
+	key rune
+}
+
+// wrapperValue is a wrapper enabled for the command being built.
+type wrapperValue struct {
+	w     *wrapper
+	value string
+}
+
+// config contains the user's preferences, which apply to all commands.
+type config struct {
+	// Merge short toggle flags (-xzvf), unless the spec says otherwise
+	ClusterShortFlags bool `yaml:"clusterShortFlags"`
+	// Wrappers that can be toggled in front of commands
+	Wrappers []*wrapper `yaml:"wrappers"`
+}
+
+func defaultWrappers() []*wrapper {
+	return []*wrapper{
+		{Name: "sudo", Help: "Run as another user", Assignments: true},
+		{Name: "time", Help: "Measure execution time"},
+		{Name: "nice", Args: []string{"-n"}, Help: "Run with a different priority",
+			Value: &option{Argument: "priority", Metavar: "priority", Default: "10", ValueType: VALUE_TYPE_INT}},
+		{Name: "timeout", Help: "Stop the command after some time",
+			Value: &option{Argument: "duration", Metavar: "duration", Default: "30s", ValueType: VALUE_TYPE_DURATION}},
+		{Name: "nohup", Help: "Keep running after the terminal is closed"},
+	}
+}
+
+func (wv *wrapperValue) render() string {
+	parts := append([]string{wv.w.Name}, wv.w.Args...)
+	if wv.w.Value != nil {
+		val := optionValue{opt: wv.w.Value, value: wv.value}
+		parts = append(parts, val.render())
+	}
+	return strings.Join(parts, " ")
 }
 
 type application struct {
 	ui                    *userInterface
 	sp                    *spec
+	cfg                   *config
 	enabledCommands       []*subcommand
-	environment           []string
+	wrappers              []*wrapperValue
+	environment           []*envvar
 	lastPrefix            rune
+	negativeArg           bool
 	tviewApp              *tview.Application
 	minibufferActive      bool
 	helpActive            bool
 	minibufferCompletions []string
+	minibufferFilter      func(string, string) bool
+	minibufferValidator   func(string) error
+	minibufferDelimiter   string
+	minibufferPrompt      string
 	inputDoneCallback     func(bool, string)
 	cursor                int
 	cursorMax             int
 	onCloseCallback       func()
 	initialized           bool
+	pendingRequirements   []*option
+	confirmFinish         bool
+	showAll               bool
+	// The version of the command being built for, if known
+	version string
+
+	// The menu group being shown, if any, and the command it belongs to
+	menu    *group
+	menuCmd *subcommand
+
+	// For nested sessions (see option.Command), the session that opened
+	// this one, and the function to call with the resulting command.
+	parent         *application
+	onNestedFinish func(string)
+}
+
+// parseVersion returns the numbers in a version string, e.g. [1, 2, 3]
+// for "v1.2.3".
+func parseVersion(version string) []int {
+	numbers := []int{}
+	for _, part := range regexp.MustCompile(`\d+`).FindAllString(version, -1) {
+		n, _ := strconv.Atoi(part)
+		numbers = append(numbers, n)
+	}
+	return numbers
+}
+
+// compareVersions returns -1, 0 or 1 when version a is lower than, equal
+// to or greater than b. Missing numbers are taken as zero.
+func compareVersions(a, b string) int {
+	va, vb := parseVersion(a), parseVersion(b)
+	for i := 0; i < len(va) || i < len(vb); i++ {
+		na, nb := 0, 0
+		if i < len(va) {
+			na = va[i]
+		}
+		if i < len(vb) {
+			nb = vb[i]
+		}
+
+		if na < nb {
+			return -1
+		} else if na > nb {
+			return 1
+		}
+	}
+	return 0
+}
+
+// isAvailable reports whether something available from version since
+// and before version until can be used with the command's version. When
+// the version is unknown, everything is available.
+func (app *application) isAvailable(since, until string) bool {
+	if app.version == "" {
+		return true
+	}
+	return (since == "" || compareVersions(app.version, since) >= 0) &&
+		(until == "" || compareVersions(app.version, until) < 0)
+}
+
+// isOptionShown reports whether opt is shown and given keys. Hidden
+// options, and the ones not available in the command's version, are
+// only shown when all options are being shown.
+func (app *application) isOptionShown(opt *option) bool {
+	return app.showAll || (!opt.Hidden && app.isAvailable(opt.Since, opt.Until))
+}
+
+func (app *application) isCommandShown(cmd *subcommand) bool {
+	return app.showAll || (!cmd.Hidden && app.isAvailable(cmd.Since, cmd.Until))
 }
 
 func isPrefix(r rune) bool {
@@ -183,923 +665,3816 @@ func (opt *option) mainFlag() string {
 	return opt.Flags[0]
 }
 
-func (cmd *subcommand) deleteOptionValueAt(index int) {
-	cmd.optValues = append(cmd.optValues[:index], cmd.optValues[index+1:]...)
+func (opt *option) getValueType() string {
+	if opt.ValueType == "" {
+		return VALUE_TYPE_STRING
+	}
+	return opt.ValueType
 }
 
-func (cmd *subcommand) deleteOptionValuesFor(opt *option) {
-	if len(cmd.optValues) == 0 {
-		return
+func (opt *option) metavar() string {
+	if opt.Metavar != "" {
+		return opt.Metavar
+	} else if len(opt.Choices) > 0 {
+		return strings.Join(opt.Choices, "|")
+	} else if opt.ValueType != "" {
+		return opt.ValueType
 	}
-	newValues := make([]*optionValue, 0, len(cmd.optValues))
-	for _, val := range cmd.optValues {
-		if val.opt != opt {
-			newValues = append(newValues, val)
-		}
+	return "value"
+}
+
+func (opt *option) completions() []string {
+	if len(opt.Completion.Values) > 0 {
+		return opt.Completion.Values
+	} else if len(opt.Choices) > 0 {
+		return opt.Choices
 	}
+	return nil
+}
 
-	cmd.optValues = newValues
+func (opt *option) checkRange(n float64) error {
+	if opt.Min != nil && n < *opt.Min {
+		return fmt.Errorf("must be at least %v", *opt.Min)
+	} else if opt.Max != nil && n > *opt.Max {
+		return fmt.Errorf("must be at most %v", *opt.Max)
+	}
+	return nil
 }
 
-func (cmd *subcommand) isOptionEnabled(opt *option) bool {
-	for _, val := range cmd.optValues {
-		if val.opt == opt {
-			return true
+func (opt *option) delimiter() string {
+	if opt.Delimiter != "" {
+		return opt.Delimiter
+	}
+	return DEFAULT_DELIMITER
+}
+
+// validateValue checks that val is a valid value for the option, according
+// to its value type and constraints. The values of list options are
+// checked one by one.
+func (opt *option) validateValue(val string) error {
+	if val == "" && opt.isFlag() && opt.getType() == FLAG_TYPE_VALUE_OPTIONAL {
+		return nil
+	}
+
+	if !opt.List {
+		return opt.validateItem(val)
+	} else if val == "" {
+		// Clearing a list disables its option
+		return nil
+	}
+
+	for _, item := range strings.Split(val, opt.delimiter()) {
+		if err := opt.validateItem(item); err != nil {
+			return fmt.Errorf("%v %v", item, err)
 		}
 	}
-	return false
+	return nil
 }
 
-func newApplication(sp *spec) *application {
-	root := subcommand{
-		Name:        sp.Command.Name,
-		Subcommands: sp.Command.Subcommands,
-		Options:     sp.Command.Options,
-		Help:        sp.Command.Help,
+func (opt *option) validateItem(val string) error {
+	switch opt.getValueType() {
+	case VALUE_TYPE_INT:
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		if err := opt.checkRange(float64(n)); err != nil {
+			return err
+		}
+	case VALUE_TYPE_FLOAT:
+		n, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		if err := opt.checkRange(n); err != nil {
+			return err
+		}
+	case VALUE_TYPE_ENUM:
+		if len(opt.Choices) == 0 {
+			return errors.New("no choices defined")
+		}
+	case VALUE_TYPE_PATH:
+		if val == "" {
+			return errors.New("must be a path")
+		}
+	case VALUE_TYPE_DURATION:
+		if _, err := time.ParseDuration(val); err != nil {
+			return errors.New("must be a duration (e.g. 30s, 5m)")
+		}
+	case VALUE_TYPE_URL:
+		u, err := url.Parse(val)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return errors.New("must be a URL")
+		}
+	case VALUE_TYPE_REGEX:
+		if _, err := regexp.Compile(val); err != nil {
+			return errors.New("must be a regular expression")
+		}
 	}
 
-	app := application{
-		ui:              newUserInterface(len(root.Subcommands) > 0),
-		sp:              sp,
-		enabledCommands: []*subcommand{&root},
-		tviewApp:        tview.NewApplication(),
-		cursor:          math.MaxInt,
+	if len(opt.Choices) > 0 {
+		found := false
+		for _, choice := range opt.Choices {
+			if choice == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("must be one of %v", strings.Join(opt.Choices, ", "))
+		}
 	}
 
-	app.ui.root.SetInputCapture(app.captureRootInput)
-	app.ui.minibuffer.SetInputCapture(app.captureMinibufferInput)
-	app.ui.minibuffer.SetDoneFunc(app.minibufferDone)
-	app.ui.minibuffer.SetAutocompleteFunc(app.minibufferAutocomplete)
-	app.ui.minibuffer.SetAutocompletedFunc(app.minibufferAutocompletedFunc)
-	app.tviewApp.SetRoot(app.ui.root, true)
+	if opt.Pattern != "" {
+		match, err := regexp.MatchString("^(?:"+opt.Pattern+")$", val)
+		if err != nil || !match {
+			return fmt.Errorf("must match %v", opt.Pattern)
+		}
+	}
 
-	return &app
+	return nil
 }
 
-func (app *application) visibleCommands() []*subcommand {
-	return app.enabledCommands[len(app.enabledCommands)-1].Subcommands
+// isChoice reports whether the option's value is selected by cycling
+// through its choices with repeated key presses.
+func (opt *option) isChoice() bool {
+	return opt.isFlag() && len(opt.Choices) > 0 && !opt.isRepeatable() && !opt.List
 }
 
-func (app *application) updateKeys() {
-	app.assignCommandKeys()
-	app.assignFlagKeys()
-	app.assignArgumentKeys()
+func (opt *option) isNegatable() bool {
+	return opt.isFlag() && opt.getType() == FLAG_TYPE_TOGGLE && opt.Negatable
 }
 
-func (app *application) getHeight() int {
-	_, _, _, height := app.ui.root.GetRect()
-	return height
+func (opt *option) isCount() bool {
+	return opt.isFlag() && opt.getType() == FLAG_TYPE_COUNT
 }
 
-func (app *application) assignArgumentKeys() {
-	used := make(map[rune]struct{})
+// countFlag renders a count flag that has been used n times.
+func (opt *option) countFlag(flag string, n int) string {
+	if opt.CountStyle != COUNT_STYLE_REPEATED && len(flag) == 2 {
+		return flag + strings.Repeat(flag[1:], n-1)
+	}
+	return strings.TrimSpace(strings.Repeat(flag+" ", n))
+}
 
-	for _, cmd := range app.enabledCommands {
-		for _, opt := range cmd.Options {
-			if !opt.isArgument() {
-				continue
-			}
+// negatedFlag returns the negated form of the option's flag, e.g.
+// --no-color for --color.
+func (opt *option) negatedFlag() string {
+	if opt.Negation != "" {
+		return opt.Negation
+	}
 
-			opt.key = 0
-			opt.prefix = 0
+	flag := opt.longFlag()
+	if flag == "" {
+		flag = opt.mainFlag()
+	}
 
-			for _, r := range []rune(DIGITS) {
-				_, found := used[r]
-				if !found {
-					opt.key = r
-					used[r] = struct{}{}
-					break
-				}
-			}
+	rest := strings.TrimLeft(flag, string(PREFIX_DASH))
+	return flag[:len(flag)-len(rest)] + "no-" + rest
+}
 
-			if opt.key == 0 {
-				panic("no key found for argument")
-			}
-		}
-	}
+// expandTemplate returns the option's template flag (e.g.
+// --http<version>) with the placeholder replaced by val.
+func (opt *option) expandTemplate(val string) string {
+	re := regexp.MustCompile("<.+?>")
+	return re.ReplaceAllLiteralString(opt.longFlag(), val)
 }
 
-func (app *application) assignFlagPrefixKey(opt *option, prefix, r rune, used map[string]struct{}) bool {
-	candidates := []string{string([]rune{prefix, r})}
+func (opt *option) isRest() bool {
+	return opt.isArgument() && opt.FlagType == ARGUMENT_TYPE_REST
+}
 
-	if prefix == PREFIX_DASH {
-		candidates = append(candidates, string([]rune{PREFIX_EQUALS, r}))
+// isVerbatim reports whether the option's values are rendered exactly as
+// they are, without any quoting.
+func (opt *option) isVerbatim() bool {
+	return opt.isRest() || (opt.isArgument() && opt.Command)
+}
+
+// nargs returns the minimum and maximum amount of values set by the
+// option's nargs attribute (0 meaning no maximum), and whether it was set
+// at all.
+func (opt *option) nargs() (int, int, bool) {
+	switch opt.Nargs {
+	case "":
+		return 0, 0, false
+	case NARGS_OPTIONAL:
+		return 0, 1, true
+	case NARGS_ANY:
+		return 0, 0, true
+	case NARGS_SOME:
+		return 1, 0, true
 	}
 
-	for _, candidate := range candidates {
-		_, found := used[candidate]
-		if !found {
-			opt.prefix = ([]rune(candidate))[0]
-			opt.key = ([]rune(candidate))[1]
-			used[candidate] = struct{}{}
-			return true
-		}
+	n, err := strconv.Atoi(opt.Nargs)
+	if err != nil || n < 1 {
+		return 0, 0, false
 	}
+	return n, n, true
+}
 
-	return false
+func (opt *option) minOccurs() int {
+	min, _, ok := opt.nargs()
+	if opt.MinOccurs > 0 {
+		return opt.MinOccurs
+	} else if ok {
+		return min
+	} else if opt.Required {
+		return 1
+	}
+	return 0
 }
 
-func (app *application) assignFlagKeys() {
-	used := make(map[string]struct{})
+// maxOccurs returns the maximum amount of values the option can have, or
+// 0 if there is no limit.
+func (opt *option) maxOccurs() int {
+	_, max, ok := opt.nargs()
+	if opt.MaxOccurs > 0 {
+		return opt.MaxOccurs
+	} else if ok {
+		return max
+	} else if opt.Repeatable || opt.isCount() {
+		return 0
+	}
+	return 1
+}
 
-	for _, cmd := range app.enabledCommands {
-		for _, opt := range cmd.Options {
-			if !opt.isFlag() {
-				continue
-			}
+// isRepeatable reports whether the option can have more than one value.
+func (opt *option) isRepeatable() bool {
+	return opt.maxOccurs() != 1 && !opt.isCount()
+}
 
-			opt.key = 0
-			opt.prefix = 0
+// keySequence returns the keys that activate the option.
+func (opt *option) keySequence() string {
+	if opt.key == 0 {
+		// Options in menus have no keys until the menu is opened
+		return ""
+	} else if opt.prefix == 0 {
+		return string(opt.key)
+	}
+	return string(opt.prefix) + string(opt.key)
+}
 
-			prefix := ([]rune(opt.mainFlag()))[0]
-			var found bool
+// name returns the name used to refer to the option in messages: its
+// main flag, or the name of the argument.
+func (opt *option) name() string {
+	if opt.isFlag() {
+		return opt.mainFlag()
+	}
+	return "<" + opt.Argument + ">"
+}
 
-			for _, r := range opt.mainFlag() + opt.longFlag() {
-				if !strings.ContainsRune(LETTERS, r) && !strings.ContainsRune(DIGITS, r) {
-					continue
-				}
+// hasName reports whether ref refers to this option, either by one of
+// its flags or by its argument name.
+func (opt *option) hasName(ref string) bool {
+	if opt.isArgument() {
+		return opt.Argument == ref
+	}
 
-				found = app.assignFlagPrefixKey(opt, prefix, r, used)
-				if found {
-					break
-				}
-			}
+	for _, flag := range opt.Flags {
+		if flag == ref {
+			return true
+		}
+	}
+	return false
+}
 
-			if !found {
-				for _, r := range []rune(LETTERS + DIGITS) {
-					found = app.assignFlagPrefixKey(opt, prefix, r, used)
-					if found {
-						break
-					}
-				}
-			}
+func (opt *option) conflictsWith(other *option) bool {
+	for _, ref := range opt.Conflicts {
+		if other.hasName(ref) {
+			return true
+		}
+	}
+	return false
+}
 
-			if !found {
-				panic("no key found for flag")
+func (cmd *subcommand) names() []string {
+	return append([]string{cmd.Name}, cmd.Aliases...)
+}
+
+func (cmd *subcommand) hasName(name string) bool {
+	for _, n := range cmd.names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// argumentOrder returns the position of an argument in the command: its
+// declared position, or otherwise its position among the arguments in
+// the spec. Rest arguments always go last.
+func (cmd *subcommand) argumentOrder(opt *option) int {
+	if opt.isRest() {
+		return math.MaxInt
+	} else if opt.Position > 0 {
+		return opt.Position
+	}
+
+	n := 0
+	for _, o := range cmd.Options {
+		if o.isArgument() {
+			n++
+		}
+		if o == opt {
+			break
+		}
+	}
+	return n
+}
+
+// insertOptionValue adds val to the command's values, as close to index
+// at as possible (or after the others, if at is -1). Flags are always
+// placed before arguments, and arguments are sorted by their order, so
+// that they are rendered correctly regardless of the order in which they
+// were entered.
+func (cmd *subcommand) insertOptionValue(val *optionValue, at int) {
+	// Values between lo and hi can be placed before val
+	lo, hi := 0, len(cmd.optValues)
+	for i, other := range cmd.optValues {
+		if other.opt.isFlag() {
+			if val.opt.isArgument() {
+				lo = i + 1
 			}
+			continue
+		}
+
+		// Arguments with a declared position go before the ones that
+		// happen to be at that same position in the spec.
+		order, otherOrder := cmd.argumentOrder(val.opt), cmd.argumentOrder(other.opt)
+		if val.opt.isFlag() || otherOrder > order ||
+			(otherOrder == order && val.opt.Position > 0 && other.opt.Position == 0) {
+			hi = i
+			break
+		}
+
+		if otherOrder < order || (other.opt.Position > 0 && val.opt.Position == 0) {
+			lo = i + 1
 		}
 	}
+
+	index := hi
+	if at >= lo && at < hi {
+		index = at
+	}
+
+	cmd.optValues = append(cmd.optValues, nil)
+	copy(cmd.optValues[index+1:], cmd.optValues[index:])
+	cmd.optValues[index] = val
 }
 
-func (app *application) assignCommandKeys() {
-	used := make(map[rune]struct{})
+// moveOptionValue moves the value at index one place to the left or to the
+// right. Flags can only be swapped with other flags, and arguments with
+// values of the same argument, as their order is given by the spec.
+func (cmd *subcommand) moveOptionValue(index int, left bool) error {
+	other := index + 1
+	if left {
+		other = index - 1
+	}
 
-	for _, cmd := range app.visibleCommands() {
-		cmd.key = 0
-		name := []rune(cmd.Name)
+	if other < 0 || other >= len(cmd.optValues) {
+		return errors.New("unable to move it any further")
+	}
 
-		for _, r := range name {
-			_, contained := used[r]
-			if !contained {
-				used[r] = struct{}{}
-				cmd.key = r
+	val, otherVal := cmd.optValues[index], cmd.optValues[other]
+	if !(val.opt.isFlag() && otherVal.opt.isFlag()) && val.opt != otherVal.opt {
+		return fmt.Errorf("unable to move it past %v", otherVal.opt.name())
+	}
+
+	cmd.optValues[index], cmd.optValues[other] = otherVal, val
+	return nil
+}
+
+// sections returns the command's options split by group, starting with
+// the options that don't belong to any group.
+func (cmd *subcommand) sections() []optionSection {
+	sections := []optionSection{{}}
+	for _, g := range cmd.Groups {
+		sections = append(sections, optionSection{group: g})
+	}
+
+	for _, opt := range cmd.Options {
+		for i := range sections {
+			if (sections[i].group == nil && opt.Group == "") ||
+				(sections[i].group != nil && sections[i].group.Name == opt.Group) {
+				sections[i].options = append(sections[i].options, opt)
 				break
 			}
 		}
+	}
+
+	return sections
+}
+
+func (cmd *subcommand) deleteOptionValueAt(index int) {
+	cmd.optValues = append(cmd.optValues[:index], cmd.optValues[index+1:]...)
+}
+
+func (cmd *subcommand) deleteOptionValuesFor(opt *option) {
+	if len(cmd.optValues) == 0 {
+		return
+	}
+	newValues := make([]*optionValue, 0, len(cmd.optValues))
+	for _, val := range cmd.optValues {
+		if val.opt != opt {
+			newValues = append(newValues, val)
+		}
+	}
 
-		if cmd.key == 0 {
-			// Key still hasn't been assigned, use a random one
-			for _, r := range []rune(LETTERS) {
-				_, contained := used[r]
-				if !contained {
-					used[r] = struct{}{}
-					cmd.key = r
-					break
-				}
-			}
+	cmd.optValues = newValues
+}
+
+func (cmd *subcommand) countOptionValues(opt *option) int {
+	if opt.isCount() {
+		// Count flags hold the amount of times they've been used as
+		// their value.
+		if val := cmd.optionValueFor(opt); val != nil {
+			n, _ := strconv.Atoi(val.value)
+			return n
 		}
+		return 0
+	}
 
-		if cmd.key == 0 {
-			panic("no key found for command")
+	count := 0
+	for _, val := range cmd.optValues {
+		if val.opt == opt {
+			count++
 		}
 	}
+	return count
 }
 
-func (app *application) minibufferDone(key tcell.Key) {
-	app.ui.root.RemoveItem(app.ui.minibuffer)
-	app.tviewApp.SetFocus(app.ui.root)
-	app.minibufferActive = false
-	app.minibufferCompletions = nil
+// optionValueFor returns the first value of opt, or nil if the option is
+// not enabled.
+func (cmd *subcommand) optionValueFor(opt *option) *optionValue {
+	for _, val := range cmd.optValues {
+		if val.opt == opt {
+			return val
+		}
+	}
+	return nil
+}
 
-	app.ui.root.AddItem(app.ui.messagesTextView, 1, 0, false)
+func (cmd *subcommand) isOptionEnabled(opt *option) bool {
+	for _, val := range cmd.optValues {
+		if val.opt == opt {
+			return true
+		}
+	}
+	return false
+}
 
-	// Invoke the callback after clearing all state, as the callback
-	// may call minibufferRead again. This happens in cases where
-	// two consecutive values need to be read.
-	app.inputDoneCallback(key == tcell.KeyEnter, app.ui.minibuffer.GetText())
-	app.updateViews()
+func newApplication(sp *spec, cfg *config, tviewApp *tview.Application) *application {
+	root := subcommand{
+		Name:              sp.Command.Name,
+		Subcommands:       sp.Command.Subcommands,
+		Options:           sp.Command.Options,
+		Help:              sp.Command.Help,
+		Description:       sp.Command.Description,
+		Groups:            sp.Command.Groups,
+		ClusterShortFlags: sp.Command.ClusterShortFlags,
+	}
+
+	app := application{
+		ui:              newUserInterface(len(root.Subcommands) > 0),
+		sp:              sp,
+		cfg:             cfg,
+		enabledCommands: []*subcommand{&root},
+		tviewApp:        tviewApp,
+		cursor:          math.MaxInt,
+	}
+
+	app.ui.root.SetInputCapture(app.captureRootInput)
+	app.ui.minibuffer.SetInputCapture(app.captureMinibufferInput)
+	app.ui.minibuffer.SetDoneFunc(app.minibufferDone)
+	app.ui.minibuffer.SetAutocompleteFunc(app.minibufferAutocomplete)
+	app.ui.minibuffer.SetAutocompletedFunc(app.minibufferAutocompletedFunc)
+	app.ui.minibuffer.SetChangedFunc(app.minibufferChanged)
+
+	return &app
 }
 
-func (app *application) minibufferRead(prompt string, callback func(bool, string), default_ string, placeholder string, completions []string) {
-	app.ui.root.RemoveItem(app.ui.messagesTextView)
-	app.ui.root.AddItem(app.ui.minibuffer, 1, 0, true)
-	app.ui.minibuffer.SetLabel(" " + prompt + " ")
-	app.ui.minibuffer.SetText(default_)
-	app.ui.minibuffer.SetPlaceholder(placeholder)
-	app.tviewApp.SetFocus(app.ui.minibuffer)
-	app.minibufferActive = true
-	app.minibufferCompletions = completions
-	app.inputDoneCallback = callback
+// show makes the application's interface the one on screen.
+func (app *application) show() {
+	app.tviewApp.SetRoot(app.ui.root, true)
+	// Queue a key-press event so that captureRootInput is called immediately
+	// after tview has finished setting up the application. This in turn allows
+	// brief to do some further initialization (e.g. updating views for the first
+	// time).
+	app.tviewApp.QueueEvent(tcell.NewEventKey(CANCEL_KEY, 0, tcell.ModNone))
+}
 
-	if app.minibufferCompletions != nil {
-		app.ui.minibuffer.Autocomplete()
+// findOption looks up an option in the enabled commands, given one of its
+// flags or its argument name.
+func (app *application) findOption(ref string) (*subcommand, *option) {
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if opt.hasName(ref) {
+				return cmd, opt
+			}
+		}
 	}
+	return nil, nil
 }
 
-func (app *application) minibufferAutocomplete(currentText string) []string {
-	if app.minibufferCompletions == nil || len(app.minibufferCompletions) == 0 {
-		return nil
+// commandFor returns the enabled command that owns opt.
+func (app *application) commandFor(opt *option) *subcommand {
+	for _, cmd := range app.enabledCommands {
+		for _, o := range cmd.Options {
+			if o == opt {
+				return cmd
+			}
+		}
 	}
+	return nil
+}
 
-	completions := []string{}
-	count := 0
-	for _, candidate := range app.minibufferCompletions {
-		match := strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(currentText))
+// conflictingOptions returns the enabled options that conflict with opt.
+// Conflicts are symmetric, so it is enough for one of the two options to
+// declare it.
+func (app *application) conflictingOptions(opt *option) []*option {
+	conflicts := []*option{}
+	for _, cmd := range app.enabledCommands {
+		for _, other := range cmd.Options {
+			if other == opt || !cmd.isOptionEnabled(other) {
+				continue
+			}
 
-		if match {
-			count++
-			height := app.getHeight()
-			// By substracting 3 we leave some space on top and below the list to
-			// make the presentation nicer.
-			if len(completions) < height-3 {
-				completions = append(completions, candidate)
+			if opt.conflictsWith(other) || other.conflictsWith(opt) {
+				conflicts = append(conflicts, other)
 			}
 		}
 	}
+	return conflicts
+}
 
-	if count > len(completions) {
-		completions = append(completions, fmt.Sprintf(" [%v results omitted]", count-len(completions)))
+// missingOptions returns the options of the enabled commands that don't
+// have as many values as they require. Options that require more than one
+// value are repeated in the result, once per missing value.
+func (app *application) missingOptions() []*option {
+	missing := []*option{}
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			for i := cmd.countOptionValues(opt); i < opt.minOccurs(); i++ {
+				missing = append(missing, opt)
+			}
+		}
 	}
+	return missing
+}
 
-	return completions
+func dedupOptions(opts []*option) []*option {
+	seen := make(map[*option]struct{})
+	result := []*option{}
+	for _, opt := range opts {
+		if _, found := seen[opt]; !found {
+			seen[opt] = struct{}{}
+			result = append(result, opt)
+		}
+	}
+	return result
 }
 
-func (app *application) minibufferAutocompletedFunc(text string, index, source int) bool {
-	if source != tview.AutocompletedNavigate {
-		app.ui.minibuffer.SetText(text)
+func optionNames(opts []*option) string {
+	names := make([]string, len(opts))
+	for i, opt := range opts {
+		names[i] = opt.name()
 	}
-	return source == tview.AutocompletedEnter || source == tview.AutocompletedClick
+	return strings.Join(names, ", ")
 }
 
-func (app *application) showMessage(format string, a ...any) {
-	app.ui.messagesTextView.SetText(fmt.Sprintf(" "+format, a...))
+// clusterShortFlags reports whether short flags should be clustered for
+// cmd. The spec's setting takes precedence over the user's preference.
+func (app *application) clusterShortFlags(cmd *subcommand) bool {
+	if cmd.ClusterShortFlags != nil {
+		return *cmd.ClusterShortFlags
+	}
+	return app.cfg.ClusterShortFlags
 }
 
-func (app *application) updateSubcommandsView() {
-	commands := app.visibleCommands()
-	if len(commands) == 0 {
-		app.ui.subcommandsTextView.SetText("")
-		return
+// components returns all the parts of the command being built, in the
+// order they are shown.
+func (app *application) components() []component {
+	comps := []component{}
+	for i := range app.wrappers {
+		comps = append(comps, component{kind: COMPONENT_WRAPPER, index: i})
 	}
 
-	cmdText := NewUIText(false, 0)
+	for i := range app.environment {
+		comps = append(comps, component{kind: COMPONENT_ENVVAR, index: i})
+	}
 
-	if app.lastPrefix != 0 {
-		cmdText.dim()
+	for _, cmd := range app.enabledCommands {
+		comps = append(comps, component{kind: COMPONENT_COMMAND, cmd: cmd})
+
+		separated := false
+		for _, val := range cmd.optValues {
+			if !separated && val.needsDoubleDash() {
+				comps = append(comps, component{kind: COMPONENT_SEPARATOR, cmd: cmd})
+				separated = true
+			}
+			comps = append(comps, component{kind: COMPONENT_VALUE, cmd: cmd, val: val})
+		}
+	}
+
+	return comps
+}
+
+// scopedOptions returns the options of cmd that can currently be given
+// keys. While a menu is open, only the options in it can be. Otherwise,
+// only the options outside of any menu can be.
+func (app *application) scopedOptions(cmd *subcommand) []*option {
+	if app.menu != nil && cmd != app.menuCmd {
+		return nil
+	}
+
+	result := []*option{}
+	for _, section := range cmd.sections() {
+		inMenu := section.group != nil && section.group.isMenu()
+		if (app.menu == nil && !inMenu) || (app.menu != nil && section.group == app.menu) {
+			for _, opt := range section.options {
+				if app.isOptionShown(opt) {
+					result = append(result, opt)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// commandIndex returns the index of cmd in app.enabledCommands, or -1 if
+// it is not enabled.
+func (app *application) commandIndex(cmd *subcommand) int {
+	for i, c := range app.enabledCommands {
+		if c == cmd {
+			return i
+		}
+	}
+	return -1
+}
+
+// visibleCommands returns the subcommands of the last enabled command,
+// except for the hidden ones (unless all are being shown).
+func (app *application) visibleCommands() []*subcommand {
+	result := []*subcommand{}
+	for _, cmd := range app.enabledCommands[len(app.enabledCommands)-1].Subcommands {
+		if app.isCommandShown(cmd) {
+			result = append(result, cmd)
+		}
+	}
+	return result
+}
+
+func (app *application) updateKeys() {
+	if app.menu != nil && app.commandIndex(app.menuCmd) == -1 {
+		app.closeMenu()
 	}
 
-	for _, cmd := range commands {
-		cmdText.color(KEY_COLOR).bold().write(" " + string(cmd.key) + "  ")
-		cmdText.nocolor().unbold()
-		cmdText.write(cmd.Name)
-		if cmd.Help != "" {
-			cmdText.dim().write(" " + cmd.Help)
-			if app.lastPrefix == 0 {
-				cmdText.undim()
+	app.assignWrapperKeys()
+	app.assignEnvvarKeys()
+	app.assignGroupKeys()
+	app.assignCommandKeys()
+	app.assignFlagKeys()
+	app.assignArgumentKeys()
+}
+
+func (app *application) getHeight() int {
+	_, _, _, height := app.ui.root.GetRect()
+	return height
+}
+
+func (app *application) assignArgumentKeys() {
+	used := make(map[rune]struct{})
+
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if opt.isArgument() {
+				opt.key = 0
+			}
+		}
+
+		for _, opt := range app.scopedOptions(cmd) {
+			if !opt.isArgument() {
+				continue
+			}
+
+			for _, r := range []rune(DIGITS) {
+				_, found := used[r]
+				if !found {
+					opt.key = r
+					used[r] = struct{}{}
+					break
+				}
+			}
+
+			if opt.key == 0 {
+				panic("no key found for argument")
+			}
+		}
+	}
+}
+
+func (app *application) assignFlagPrefixKey(opt *option, prefix, r rune, used map[string]struct{}) bool {
+	candidates := []string{string([]rune{prefix, r})}
+
+	if prefix == PREFIX_DASH {
+		candidates = append(candidates, string([]rune{PREFIX_EQUALS, r}))
+	}
+
+	for _, candidate := range candidates {
+		_, found := used[candidate]
+		if !found {
+			opt.prefix = ([]rune(candidate))[0]
+			opt.key = ([]rune(candidate))[1]
+			used[candidate] = struct{}{}
+			return true
+		}
+	}
+
+	return false
+}
+
+func (app *application) assignFlagKeys() {
+	used := make(map[string]struct{})
+
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if opt.isFlag() {
+				opt.key = 0
+				opt.prefix = 0
+			}
+		}
+
+		for _, opt := range app.scopedOptions(cmd) {
+			if !opt.isFlag() {
+				continue
+			}
+
+			prefix := ([]rune(opt.mainFlag()))[0]
+			keys := LETTERS + DIGITS
+			if app.menu != nil {
+				// Flags in menus are activated with a single letter, as
+				// digits are used for arguments
+				prefix = 0
+				keys = LETTERS
+			}
+			var found bool
+
+			for _, r := range opt.Extensions.brief("key") + opt.mainFlag() + opt.longFlag() {
+				if !strings.ContainsRune(keys, r) {
+					continue
+				}
+
+				found = app.assignFlagPrefixKey(opt, prefix, r, used)
+				if found {
+					break
+				}
+			}
+
+			if !found {
+				for _, r := range []rune(keys) {
+					found = app.assignFlagPrefixKey(opt, prefix, r, used)
+					if found {
+						break
+					}
+				}
+			}
+
+			if !found && app.menu != nil {
+				// Leave the flag without a key, it can still be activated
+				// with the filter
+				continue
+			}
+
+			if !found {
+				panic("no key found for flag")
+			}
+		}
+	}
+}
+
+func (app *application) assignWrapperKeys() {
+	used := make(map[rune]struct{})
+
+	for _, w := range app.cfg.Wrappers {
+		w.key = 0
+
+		for _, r := range w.Key + w.Name + LETTERS {
+			if !strings.ContainsRune(LETTERS, r) {
+				continue
+			}
+
+			_, contained := used[r]
+			if !contained {
+				used[r] = struct{}{}
+				w.key = r
+				break
+			}
+		}
+	}
+}
+
+func (app *application) assignEnvvarKeys() {
+	used := make(map[rune]struct{})
+
+	for _, decl := range app.sp.Command.Environment {
+		decl.key = 0
+
+		for _, r := range strings.ToLower(decl.Name) + LETTERS {
+			if !strings.ContainsRune(LETTERS, r) {
+				continue
+			}
+
+			_, contained := used[r]
+			if !contained {
+				used[r] = struct{}{}
+				decl.key = r
+				break
+			}
+		}
+	}
+}
+
+func (app *application) assignGroupKeys() {
+	used := make(map[rune]struct{})
+
+	for _, cmd := range app.enabledCommands {
+		for _, g := range cmd.Groups {
+			g.key = 0
+			if g.isMenu() {
+				continue
+			}
+
+			for _, r := range strings.ToLower(g.Name) + LETTERS {
+				if !strings.ContainsRune(LETTERS, r) {
+					continue
+				}
+
+				_, contained := used[r]
+				if !contained {
+					used[r] = struct{}{}
+					g.key = r
+					break
+				}
+			}
+		}
+	}
+}
+
+func (app *application) assignCommandKeys() {
+	used := make(map[rune]struct{})
+
+	// Menu keys are set by the spec, so they take precedence
+	for _, cmd := range app.enabledCommands {
+		for _, g := range cmd.Groups {
+			if g.isMenu() {
+				used[g.menuKey()] = struct{}{}
+			}
+		}
+	}
+
+	for _, cmd := range app.visibleCommands() {
+		cmd.key = 0
+
+		for _, r := range cmd.Extensions.brief("key") + strings.Join(cmd.names(), "") {
+			if !strings.ContainsRune(LETTERS, r) {
+				continue
+			}
+
+			_, contained := used[r]
+			if !contained {
+				used[r] = struct{}{}
+				cmd.key = r
+				break
+			}
+		}
+
+		if cmd.key == 0 {
+			// Key still hasn't been assigned, use a random one
+			for _, r := range []rune(LETTERS) {
+				_, contained := used[r]
+				if !contained {
+					used[r] = struct{}{}
+					cmd.key = r
+					break
+				}
+			}
+		}
+
+		// If there are no letters left, the command is left without a
+		// key. It can still be enabled by using the search key.
+	}
+}
+
+func (app *application) minibufferDone(key tcell.Key) {
+	if app.minibufferDelimiter != "" {
+		if key == tcell.KeyTab || key == tcell.KeyBacktab {
+			// In multi-select mode, Tab is used to mark entries, so it
+			// must not cancel the input when the list is closed: open
+			// it again instead (if there is one), the same way the Down
+			// key does. The list can't be opened directly while the input
+			// field is handling the key.
+			app.tviewApp.QueueEvent(tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone))
+			return
+		}
+
+		if key == tcell.KeyEnter {
+			text := app.ui.minibuffer.GetText()
+			app.ui.minibuffer.SetText(strings.TrimSuffix(text, app.minibufferDelimiter))
+		}
+	}
+
+	if key == tcell.KeyEnter && app.minibufferValidator != nil {
+		err := app.minibufferValidator(app.ui.minibuffer.GetText())
+		if err != nil {
+			// Keep the minibuffer open until a valid value is entered,
+			// or input is cancelled.
+			app.ui.minibuffer.SetLabel(fmt.Sprintf(" %v (%v) ", app.minibufferPrompt, err))
+			app.ui.minibuffer.SetLabelColor(tcell.ColorRed)
+			return
+		}
+	}
+
+	app.ui.root.RemoveItem(app.ui.minibuffer)
+	app.tviewApp.SetFocus(app.ui.root)
+	app.minibufferActive = false
+	app.minibufferCompletions = nil
+	app.minibufferFilter = nil
+	app.minibufferValidator = nil
+	app.minibufferDelimiter = ""
+	app.ui.minibuffer.SetMaskCharacter(0)
+
+	app.ui.root.AddItem(app.ui.messagesTextView, 1, 0, false)
+
+	// Invoke the callback after clearing all state, as the callback
+	// may call minibufferRead again. This happens in cases where
+	// two consecutive values need to be read.
+	app.inputDoneCallback(key == tcell.KeyEnter, app.ui.minibuffer.GetText())
+	app.updateViews()
+}
+
+func (app *application) minibufferRead(prompt string, callback func(bool, string), default_ string, placeholder string, completions []string) {
+	app.ui.root.RemoveItem(app.ui.messagesTextView)
+	app.ui.root.AddItem(app.ui.minibuffer, 1, 0, true)
+	app.minibufferPrompt = prompt
+	app.ui.minibuffer.SetLabel(" " + prompt + " ")
+	app.ui.minibuffer.SetLabelColor(tview.Styles.SecondaryTextColor)
+	app.ui.minibuffer.SetText(default_)
+	app.ui.minibuffer.SetPlaceholder(placeholder)
+	app.tviewApp.SetFocus(app.ui.minibuffer)
+	app.minibufferActive = true
+	app.minibufferCompletions = completions
+	app.inputDoneCallback = callback
+
+	if app.minibufferCompletions != nil {
+		app.ui.minibuffer.Autocomplete()
+	}
+}
+
+func (app *application) minibufferAutocomplete(currentText string) []string {
+	if app.minibufferCompletions == nil || len(app.minibufferCompletions) == 0 {
+		return nil
+	}
+
+	if app.minibufferDelimiter != "" {
+		return app.multiSelectAutocomplete(currentText)
+	}
+
+	filter := app.minibufferFilter
+	if filter == nil {
+		filter = strings.HasPrefix
+	}
+
+	completions := []string{}
+	count := 0
+	for _, candidate := range app.minibufferCompletions {
+		match := filter(strings.ToLower(candidate), strings.ToLower(currentText))
+
+		if match {
+			count++
+			height := app.getHeight()
+			// By substracting 3 we leave some space on top and below the list to
+			// make the presentation nicer.
+			if len(completions) < height-3 {
+				completions = append(completions, candidate)
+			}
+		}
+	}
+
+	if count > len(completions) {
+		completions = append(completions, fmt.Sprintf(" [%v results omitted]", count-len(completions)))
+	}
+
+	return completions
+}
+
+// splitSelection splits the text of a multi-select minibuffer into the
+// completions selected so far, and the text typed after them (if any).
+func (app *application) splitSelection(text string) ([]string, string) {
+	selected := []string{}
+	if text == "" {
+		return selected, ""
+	}
+
+	parts := strings.Split(text, app.minibufferDelimiter)
+	last := parts[len(parts)-1]
+	selected = append(selected, parts[:len(parts)-1]...)
+
+	for _, candidate := range app.minibufferCompletions {
+		if candidate == last {
+			return append(selected, last), ""
+		}
+	}
+	return selected, last
+}
+
+// multiSelectAutocomplete returns the completions for a multi-select
+// minibuffer, marking the ones that have already been selected.
+func (app *application) multiSelectAutocomplete(currentText string) []string {
+	selected, partial := app.splitSelection(currentText)
+
+	completions := []string{}
+	for _, candidate := range app.minibufferCompletions {
+		if !strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(partial)) {
+			continue
+		}
+
+		mark := UNSELECTED_MARK
+		for _, s := range selected {
+			if s == candidate {
+				mark = SELECTED_MARK
+				break
+			}
+		}
+
+		// See minibufferAutocomplete
+		if len(completions) < app.getHeight()-3 {
+			completions = append(completions, mark+candidate)
+		}
+	}
+
+	return completions
+}
+
+// toggleSelection selects or unselects a completion in a multi-select
+// minibuffer. Any partially typed text is replaced.
+func (app *application) toggleSelection(entry string, keep bool) {
+	candidate := strings.TrimPrefix(strings.TrimPrefix(entry, SELECTED_MARK), UNSELECTED_MARK)
+	selected, _ := app.splitSelection(app.ui.minibuffer.GetText())
+
+	newSelected := []string{}
+	found := false
+	for _, s := range selected {
+		if s == candidate {
+			found = true
+			if keep {
+				newSelected = append(newSelected, s)
+			}
+		} else {
+			newSelected = append(newSelected, s)
+		}
+	}
+
+	if !found {
+		newSelected = append(newSelected, candidate)
+	}
+
+	app.ui.minibuffer.SetText(strings.Join(newSelected, app.minibufferDelimiter))
+}
+
+// minibufferChanged validates the minibuffer's text as it is typed (if a
+// validator was set), coloring the prompt red while the value is invalid.
+func (app *application) minibufferChanged(text string) {
+	if app.minibufferValidator == nil {
+		return
+	}
+
+	app.ui.minibuffer.SetLabel(" " + app.minibufferPrompt + " ")
+	if text != "" && app.minibufferValidator(text) != nil {
+		app.ui.minibuffer.SetLabelColor(tcell.ColorRed)
+	} else {
+		app.ui.minibuffer.SetLabelColor(tview.Styles.SecondaryTextColor)
+	}
+}
+
+// readOptionValue reads a value for opt using the minibuffer. The value
+// is validated according to the option's value type and constraints.
+func (app *application) readOptionValue(opt *option, callback func(bool, string)) {
+	app.readOptionValueWithDefault(opt, opt.Default, callback)
+}
+
+func (app *application) readOptionValueWithDefault(opt *option, default_ string, callback func(bool, string)) {
+	prompt := "value:"
+	app.minibufferValidator = opt.validateValue
+	if opt.List {
+		prompt = "values:"
+		app.minibufferDelimiter = opt.delimiter()
+		if default_ != "" && len(opt.completions()) > 0 {
+			// End the current items with a delimiter, so that all of them
+			// are shown as selected and the whole list is offered.
+			default_ += app.minibufferDelimiter
+		}
+	}
+
+	app.minibufferRead(prompt, callback, default_, opt.Placeholder, opt.completions())
+}
+
+// minibufferConfirm asks the user a yes/no question, and invokes callback
+// only if the answer was yes.
+func (app *application) minibufferConfirm(prompt string, callback func()) {
+	app.minibufferRead(prompt, func(ok bool, val string) {
+		if ok && strings.HasPrefix(strings.ToLower(strings.TrimSpace(val)), "y") {
+			callback()
+		}
+	}, "", "", nil)
+}
+
+// minibufferSearch works like minibufferRead, but candidates are matched
+// against any part of their text instead of only their beginning.
+func (app *application) minibufferSearch(prompt string, callback func(bool, string), candidates []string) {
+	app.minibufferFilter = strings.Contains
+	app.minibufferRead(prompt, callback, "", "", candidates)
+}
+
+func (app *application) minibufferAutocompletedFunc(text string, index, source int) bool {
+	if app.minibufferDelimiter != "" {
+		// In multi-select mode, Tab marks or unmarks entries and keeps the
+		// list open, while Enter selects the entry and closes it.
+		if source != tview.AutocompletedNavigate {
+			app.toggleSelection(text, source != tview.AutocompletedTab)
+		}
+		return source == tview.AutocompletedEnter || source == tview.AutocompletedClick
+	}
+
+	if source != tview.AutocompletedNavigate {
+		app.ui.minibuffer.SetText(text)
+	}
+	return source == tview.AutocompletedEnter || source == tview.AutocompletedClick
+}
+
+func (app *application) showMessage(format string, a ...any) {
+	app.ui.messagesTextView.SetText(fmt.Sprintf(" "+format, a...))
+}
+
+func (app *application) updateSubcommandsView() {
+	_, _, _, pagesHeight := app.ui.subcommandsPages.GetRect()
+	cmdText := NewUIText(true, pagesHeight)
+	commands := app.visibleCommands()
+
+	if app.lastPrefix != 0 {
+		cmdText.dim()
+	}
+
+	for _, cmd := range commands {
+		key := " "
+		if cmd.key != 0 {
+			key = string(cmd.key)
+		}
+
+		cmdText.color(KEY_COLOR).bold().write(" " + key + "  ")
+		cmdText.nocolor().unbold()
+		cmdText.write(cmd.Name)
+		if len(cmd.Aliases) > 0 {
+			cmdText.dim().write(" (" + strings.Join(cmd.Aliases, ", ") + ")")
+			if app.lastPrefix == 0 {
+				cmdText.undim()
+			}
+		}
+		if cmd.Help != "" {
+			cmdText.dim().write(" ")
+			writeHelp(cmdText, cmd.Help, cmd.Deprecated)
+			if app.lastPrefix == 0 {
+				cmdText.undim()
+			}
+		}
+
+		if cmd.Hidden || cmd.Deprecated != "" || cmd.Experimental || !app.isAvailable(cmd.Since, cmd.Until) {
+			cmdText.dim()
+			writeStatusTags(cmdText, cmd.Hidden, cmd.Deprecated, cmd.Experimental)
+			app.writeVersionTag(cmdText, cmd.Since, cmd.Until)
+			if app.lastPrefix == 0 {
+				cmdText.undim()
+			}
+		}
+		cmdText.nl()
+	}
+
+	setPages(app.ui.subcommandsPages, cmdText)
+}
+
+func (app *application) updateSubcommandsTitle() {
+	// Most commands fit in a single page, so the page is only shown
+	// when there are more
+	title := "Subcommands"
+	front, _ := app.ui.subcommandsPages.GetFrontPage()
+	i, _ := strconv.Atoi(front)
+	if count := app.ui.subcommandsPages.GetPageCount(); count > 1 {
+		title += fmt.Sprintf(" (page %v of %v)", i+1, count)
+	}
+	app.ui.subcommandsFlex.SetTitle(title)
+}
+
+func (app *application) currentCommand() string {
+	return app.commandText(false)
+}
+
+// commandText returns the text of the command being built. For the
+// preview, each component is placed in its own region (so that the
+// cursor can highlight it) and secret values are masked.
+func (app *application) commandText(preview bool) string {
+	text := NewUIText(false, 0)
+	comps := app.components()
+
+	region := func(i int, contents string) string {
+		if preview {
+			return regionInt(i, contents)
+		}
+		return contents
+	}
+
+	// Short flags are merged into a single token (-xzvf) when
+	// clustering is enabled, while still using one region each.
+	var clusterPrefix byte
+
+	for i, comp := range comps {
+		sep := " "
+		if i == 0 {
+			sep = ""
+		}
+
+		switch comp.kind {
+		case COMPONENT_WRAPPER:
+			text.write(sep + region(i, app.wrappers[comp.index].render()))
+			continue
+		case COMPONENT_ENVVAR:
+			text.write(sep + region(i, app.envvarText(comp.index, preview)))
+			continue
+		case COMPONENT_SEPARATOR:
+			text.write(sep + region(i, DOUBLE_DASH))
+			clusterPrefix = 0
+			continue
+		case COMPONENT_COMMAND:
+			text.write(sep + region(i, comp.cmd.Name))
+			clusterPrefix = 0
+			continue
+		}
+
+		val := comp.val
+		valText := val.render()
+		cluster := app.clusterShortFlags(comp.cmd)
+
+		if cluster && clusterPrefix != 0 && val.clusterable() && val.flagText()[0] == clusterPrefix {
+			text.write(region(i, valText[1:]))
+		} else {
+			text.write(sep + region(i, valText))
+			clusterPrefix = 0
+			if cluster && val.clusterable() {
+				clusterPrefix = val.flagText()[0]
+			}
+		}
+
+		if val.opt.getType() != FLAG_TYPE_TOGGLE && !val.opt.isCount() {
+			// A flag with a value can only be at the end of a cluster
+			clusterPrefix = 0
+		}
+	}
+
+	if preview {
+		// Cursor can move one extra place to the right
+		text.write(" " + regionInt(len(comps), " "))
+	}
+
+	return text.page(0)
+}
+
+func (app *application) updateCmdPreviewView() {
+	app.ui.cmdPreviewTextView.SetText(app.commandText(true))
+	app.ui.cmdPreviewTextView.Highlight(strconv.Itoa(app.cursor))
+}
+
+func (app *application) updateOptionsTitle() {
+	front, _ := app.ui.optionsPages.GetFrontPage()
+	i, _ := strconv.Atoi(front)
+	count := app.ui.optionsPages.GetPageCount()
+	app.ui.optionsFlex.SetTitle(fmt.Sprintf("Options (page %v of %v)", i+1, count))
+}
+
+func (app *application) updateOptionsView() {
+	_, _, _, pagesHeight := app.ui.optionsPages.GetRect()
+	optsText := NewUIText(true, pagesHeight)
+
+	for i, cmd := range app.enabledCommands {
+		if i > 0 && len(cmd.Options) == 0 {
+			continue
+		}
+
+		if app.menu != nil {
+			if cmd == app.menuCmd {
+				app.writeMenu(optsText, cmd)
+			}
+			continue
+		}
+
+		optsText.bold().write(cmd.Name + ":").nl().unbold()
+
+		if i == 0 {
+			// With declared variables, the key is a prefix and must be
+			// pressed twice to set any other variable
+			envKey := "  " + string(ENVVAR_KEY)
+			if len(app.sp.Command.Environment) > 0 {
+				envKey = " " + string(ENVVAR_KEY) + string(ENVVAR_KEY)
+			}
+
+			if app.lastPrefix != 0 && app.lastPrefix != ENVVAR_KEY {
+				optsText.dim()
+			}
+			optsText.color(KEY_COLOR).bold()
+			optsText.write(envKey)
+			optsText.nocolor().unbold()
+			optsText.write("  Set environment variable").nl()
+			optsText.reset()
+
+			for _, decl := range app.sp.Command.Environment {
+				if app.lastPrefix != 0 && app.lastPrefix != ENVVAR_KEY {
+					optsText.dim()
+				}
+
+				optsText.color(KEY_COLOR).bold()
+				optsText.write(" " + string(ENVVAR_KEY) + string(decl.key))
+				optsText.nocolor().unbold()
+				optsText.write("  " + decl.Help)
+
+				if app.findEnvvar(decl.Name) != nil {
+					optsText.italic().color(ARG_ON_COLOR)
+				}
+				optsText.dim().write(" (" + decl.Name + ")")
+				optsText.reset().nl()
+			}
+
+			for _, w := range app.cfg.Wrappers {
+				if w.key == 0 {
+					continue
+				}
+
+				if app.lastPrefix != 0 && app.lastPrefix != WRAPPER_KEY {
+					optsText.dim()
+				}
+
+				optsText.color(KEY_COLOR).bold()
+				optsText.write(" " + string(WRAPPER_KEY) + string(w.key))
+				optsText.nocolor().unbold()
+				optsText.write("  " + w.Help)
+
+				if app.isWrapperEnabled(w) {
+					optsText.italic().color(ARG_ON_COLOR)
+				}
+
+				text := strings.Join(append([]string{w.Name}, w.Args...), " ")
+				if w.Value != nil {
+					text += " <" + w.Value.metavar() + ">"
+				}
+				optsText.dim().write(" (" + text + ")")
+				optsText.reset().nl()
+			}
+		}
+
+		sections := cmd.sections()
+		for _, section := range sections {
+			if section.group != nil {
+				app.writeGroupHeading(optsText, section)
+				if section.group.isCollapsed() {
+					continue
+				}
+			}
+
+			for _, opt := range section.options {
+				if opt.isFlag() {
+					app.writeFlagLine(optsText, cmd, opt)
+				}
+			}
+
+			for _, opt := range section.options {
+				// Arguments without a group are shown last
+				if opt.isArgument() && section.group != nil {
+					app.writeArgumentLine(optsText, cmd, opt)
+				}
+			}
+		}
+
+		for _, opt := range sections[0].options {
+			if opt.isArgument() {
+				app.writeArgumentLine(optsText, cmd, opt)
+			}
+		}
+
+		if i < len(app.enabledCommands)-1 {
+			optsText.nl()
+		}
+	}
+
+	setPages(app.ui.optionsPages, optsText)
+}
+
+// setPages replaces the contents of pages with the pages of txt, keeping
+// the one in front if it still exists.
+func setPages(pages *tview.Pages, txt *uiText) {
+	front, _ := pages.GetFrontPage()
+
+	count := pages.GetPageCount()
+	for i := 0; i < count; i++ {
+		pages.RemovePage(strconv.Itoa(i))
+	}
+
+	for i := 0; i < txt.pagesCount(); i++ {
+		view := tview.NewTextView()
+		view.SetDynamicColors(true)
+		view.SetWrap(false)
+		view.SetText(txt.page(i))
+
+		pages.AddPage(strconv.Itoa(i), view, true, true)
+	}
+
+	if pages.HasPage(front) {
+		pages.SwitchToPage(front)
+	} else {
+		pages.SwitchToPage("0")
+	}
+}
+
+// writeGroupHeading writes the heading of a group of options, keeping it
+// in the same page as the options below it when possible.
+func (app *application) writeGroupHeading(optsText *uiText, section optionSection) {
+	g := section.group
+
+	// Options hidden by other means are not counted
+	shown := 0
+	for _, opt := range section.options {
+		if app.isOptionShown(opt) {
+			shown++
+		}
+	}
+
+	lines := 1
+	if !g.isCollapsed() {
+		lines += shown
+	}
+	optsText.keepTogether(lines)
+
+	if app.lastPrefix != 0 && (app.lastPrefix != GROUP_KEY || g.isMenu()) {
+		optsText.dim()
+	}
+
+	key := string(GROUP_KEY) + string(g.key)
+	if g.isMenu() {
+		key = g.Key
+	}
+
+	optsText.color(KEY_COLOR).bold()
+	optsText.write(fmt.Sprintf("%3v", key))
+	optsText.nocolor()
+	optsText.write("  " + g.Name).unbold()
+
+	if g.Help != "" {
+		optsText.write("  " + g.Help)
+	}
+
+	if g.isMenu() {
+		optsText.dim().write(fmt.Sprintf(" (menu, %v options)", shown))
+	} else if g.isCollapsed() {
+		optsText.dim().write(fmt.Sprintf(" (%v options hidden)", shown))
+	}
+	optsText.reset().nl()
+}
+
+// writeMenu writes the options of the open menu, which belongs to cmd.
+func (app *application) writeMenu(optsText *uiText, cmd *subcommand) {
+	optsText.bold().write(cmd.Name + " > " + app.menu.Name + ":").nl().unbold()
+
+	opts := app.scopedOptions(cmd)
+	for _, opt := range opts {
+		if opt.isFlag() {
+			app.writeFlagLine(optsText, cmd, opt)
+		}
+	}
+
+	for _, opt := range opts {
+		if opt.isArgument() {
+			app.writeArgumentLine(optsText, cmd, opt)
+		}
+	}
+}
+
+// writeHelp writes the help text of a subcommand or option, which is
+// struck through if it has been deprecated.
+func writeHelp(text *uiText, help string, deprecated string) {
+	if deprecated != "" {
+		text.strike().write(help).nostrike()
+	} else {
+		text.write(help)
+	}
+}
+
+// writeStatusTags writes the tags for hidden, deprecated and experimental
+// subcommands and options.
+func writeStatusTags(text *uiText, hidden bool, deprecated string, experimental bool) {
+	// See the comment about "[" in writeFlagLine
+	if hidden {
+		text.write(" [hidden[]")
+	}
+	if deprecated != "" {
+		text.write(" [deprecated: " + tview.Escape(deprecated) + "[]")
+	}
+	if experimental {
+		text.write(" [experimental[]")
+	}
+}
+
+// writeVersionTag writes a tag for subcommands and options which are not
+// available in the command's version.
+func (app *application) writeVersionTag(text *uiText, since string, until string) {
+	if !app.isAvailable(since, until) {
+		text.write(" [not in " + app.version + "[]")
+	}
+}
+
+func (app *application) writeFlagLine(optsText *uiText, cmd *subcommand, opt *option) {
+	if !app.isOptionShown(opt) {
+		return
+	}
+
+	enabled := cmd.isOptionEnabled(opt)
+	conflicts := []*option{}
+	if !enabled {
+		conflicts = app.conflictingOptions(opt)
+	}
+
+	dim := (app.lastPrefix != 0 && opt.prefix != app.lastPrefix) || len(conflicts) > 0
+	flags := strings.Join(opt.Flags, ", ")
+	if opt.isNegatable() {
+		flags += ", " + opt.negatedFlag()
+	}
+
+	if dim {
+		optsText.dim()
+	}
+
+	optsText.color(KEY_COLOR)
+	optsText.bold().write(fmt.Sprintf("%3v", opt.keySequence())).unbold()
+	optsText.nocolor()
+
+	if opt.isChoice() || opt.isNegatable() || opt.isCount() {
+		// Show the current state of the option next to the key
+		current := "off"
+		if val := cmd.optionValueFor(opt); val != nil && (opt.isChoice() || opt.isCount()) {
+			current = val.value
+		} else if val != nil && val.flag != "" {
+			current = val.flag
+		} else if val != nil {
+			current = opt.mainFlag()
+		}
+		optsText.color(ARG_ON_COLOR).write(" " + current).nocolor()
+	}
+
+	optsText.write("  ")
+	writeHelp(optsText, opt.Help, opt.Deprecated)
+
+	if enabled {
+		optsText.italic().color(ARG_ON_COLOR)
+	}
+
+	optsText.dim().write(" (" + flags)
+
+	metavar := opt.metavar()
+
+	sep := " "
+	if opt.Separator != "" {
+		sep = opt.Separator
+	}
+
+	switch opt.getType() {
+	case FLAG_TYPE_VALUE:
+		optsText.write(sep)
+		optsText.write("<" + metavar + ">)")
+	case FLAG_TYPE_VALUE_OPTIONAL:
+		// The string to display is "[$metavar]", but an extra "[" needs to be
+		// added in order to prevent tview from interpreting it as a color tag.
+		optsText.write(sep)
+		optsText.write("[" + metavar + "[])")
+	case FLAG_TYPE_TOGGLE, FLAG_TYPE_COUNT:
+		optsText.write(")")
+	}
+
+	if opt.isRepeatable() {
+		// See comment above
+		optsText.write(" [repeatable[]")
+	}
+
+	if opt.minOccurs() > 0 {
+		optsText.write(" [required[]")
+	}
+
+	if len(conflicts) > 0 {
+		optsText.write(" [conflicts with " + optionNames(conflicts) + "[]")
+	}
+
+	writeStatusTags(optsText, opt.Hidden, opt.Deprecated, opt.Experimental)
+	app.writeVersionTag(optsText, opt.Since, opt.Until)
+	optsText.reset().nl()
+}
+
+func (app *application) writeArgumentLine(optsText *uiText, cmd *subcommand, opt *option) {
+	if !app.isOptionShown(opt) {
+		return
+	}
+
+	enabled := cmd.isOptionEnabled(opt)
+	conflicts := []*option{}
+	if !enabled {
+		conflicts = app.conflictingOptions(opt)
+	}
+
+	if app.lastPrefix != 0 || len(conflicts) > 0 {
+		optsText.dim()
+	}
+
+	metavar := opt.metavar()
+
+	optsText.color(KEY_COLOR).bold().write("  " + string(opt.key)).unbold().nocolor()
+	optsText.write("  ")
+	writeHelp(optsText, opt.Help, opt.Deprecated)
+
+	if enabled {
+		optsText.italic().color(ARG_ON_COLOR)
+	}
+
+	if opt.isRest() {
+		optsText.dim().write(" (<" + metavar + ">...)")
+	} else {
+		optsText.dim().write(" (<" + metavar + ">)")
+	}
+
+	if opt.Nargs != "" {
+		optsText.write(" [nargs " + opt.Nargs + "[]")
+	} else if opt.isRepeatable() {
+		optsText.write(" [repeatable[]")
+	}
+
+	if opt.minOccurs() > 0 {
+		optsText.write(" [required[]")
+	}
+
+	if len(conflicts) > 0 {
+		optsText.write(" [conflicts with " + optionNames(conflicts) + "[]")
+	}
+
+	writeStatusTags(optsText, opt.Hidden, opt.Deprecated, opt.Experimental)
+	app.writeVersionTag(optsText, opt.Since, opt.Until)
+	optsText.reset().nl()
+}
+
+func (app *application) updateViews() {
+	app.updateSubcommandsView()
+	app.updateSubcommandsTitle()
+	app.updateOptionsView()
+	app.updateOptionsTitle()
+	app.updateCmdPreviewView()
+	app.updateDetailsView()
+}
+
+// updateDetailsView shows everything known about the component under the
+// cursor. The view is hidden while the cursor is at the end of the
+// command.
+func (app *application) updateDetailsView() {
+	comps := app.components()
+	if app.cursor >= len(comps) {
+		app.ui.showDetails(false)
+		return
+	}
+	app.ui.showDetails(true)
+
+	text := NewUIText(false, 0)
+
+	comp := comps[app.cursor]
+	switch comp.kind {
+	case COMPONENT_WRAPPER:
+		wv := app.wrappers[comp.index]
+		text.bold().write(tview.Escape(wv.render())).unbold().nl()
+		text.field("kind", "wrapper command")
+		if wv.w.Value != nil {
+			text.field("metavar", wv.w.Value.metavar())
+			text.field("default", wv.w.Value.Default)
+		}
+		text.paragraph(wv.w.Help)
+	case COMPONENT_ENVVAR:
+		ev := app.environment[comp.index]
+		text.bold().write(tview.Escape(ev.name)).unbold().nl()
+		text.field("kind", "environment variable")
+		if ev.unset {
+			text.field("value", "(unset)")
+		} else if ev.isSecret() {
+			text.field("value", SECRET_MASK+" (secret)")
+		} else {
+			text.field("value", ev.value)
+		}
+		if current, set := os.LookupEnv(ev.name); set && !ev.isSecret() {
+			text.field("current value", current)
+		}
+		if ev.decl != nil {
+			text.paragraph(ev.decl.Help)
+		}
+	case COMPONENT_SEPARATOR:
+		text.bold().write(DOUBLE_DASH).unbold().nl()
+		text.field("kind", "end of options")
+		text.paragraph("Everything after it is taken as an argument, even if it starts with a dash.")
+	case COMPONENT_COMMAND:
+		cmd := comp.cmd
+		text.bold().write(tview.Escape(cmd.Name)).unbold().nl()
+		text.field("kind", "command")
+		if cmd == app.enabledCommands[0] {
+			text.field("version", app.version)
+		}
+		text.field("since", cmd.Since)
+		text.field("until", cmd.Until)
+		text.field("aliases", strings.Join(cmd.Aliases, ", "))
+		text.field("options", strconv.Itoa(len(cmd.Options)))
+		text.field("subcommands", strconv.Itoa(len(cmd.Subcommands)))
+		text.paragraph(cmd.Help)
+		text.paragraph(cmd.Description)
+	case COMPONENT_VALUE:
+		app.writeOptionDetails(text, comp.cmd, comp.val)
+	}
+
+	app.ui.detailsTextView.SetText(text.page(0))
+	app.ui.detailsTextView.ScrollToBeginning()
+}
+
+func (app *application) writeOptionDetails(text *uiText, cmd *subcommand, val *optionValue) {
+	opt := val.opt
+
+	text.bold().write(tview.Escape(opt.name())).unbold().nl()
+
+	path := []string{}
+	for _, c := range app.enabledCommands {
+		path = append(path, c.Name)
+		if c == cmd {
+			break
+		}
+	}
+	text.field("command", strings.Join(path, " "))
+
+	kind := "argument"
+	if opt.isFlag() {
+		kind = "flag (" + opt.getType() + ")"
+		text.field("flags", strings.Join(opt.Flags, ", "))
+	} else if opt.Command {
+		kind = "command argument"
+	} else if opt.isRest() {
+		kind = "rest argument"
+	}
+	text.field("kind", kind)
+
+	if opt.isCount() {
+		text.field("count", val.value)
+	} else if !(opt.isFlag() && opt.getType() == FLAG_TYPE_TOGGLE) {
+		text.field("value", val.value)
+		text.field("value type", opt.getValueType())
+		text.field("metavar", opt.metavar())
+		text.field("default", opt.Default)
+		text.field("choices", strings.Join(opt.Choices, ", "))
+	}
+
+	if len(opt.Completion.Values) > 0 {
+		text.field("completion", strings.Join(opt.Completion.Values, ", "))
+	} else if len(opt.Completion.Cmd) > 0 {
+		text.field("completion", "output of "+strings.Join(opt.Completion.Cmd, " "))
+	}
+
+	if opt.isArgument() && opt.Nargs != "" {
+		text.field("nargs", opt.Nargs)
+	}
+	if opt.Required {
+		text.field("required", "yes")
+	}
+	if opt.isRepeatable() {
+		text.field("repeatable", "yes")
+	}
+	text.field("since", opt.Since)
+	text.field("until", opt.Until)
+	text.field("deprecated", opt.Deprecated)
+	text.field("conflicts with", strings.Join(opt.Conflicts, ", "))
+	text.field("requires", strings.Join(opt.Requires, ", "))
+
+	text.paragraph(opt.Help)
+	text.paragraph(opt.Description)
+}
+
+func (app *application) handleDeletionKey(backspace bool) {
+	app.lastPrefix = 0
+
+	if (app.cursor >= app.cursorMax && !backspace) || (app.cursor <= 0 && backspace) {
+		app.showMessage("nothing to delete")
+		return
+	}
+
+	deleteAt := app.cursor
+	cursorModifier := 0
+	if backspace {
+		deleteAt--
+		cursorModifier = -1
+	}
+
+	comp := app.components()[deleteAt]
+
+	switch comp.kind {
+	case COMPONENT_WRAPPER:
+		app.wrappers = append(app.wrappers[:comp.index], app.wrappers[comp.index+1:]...)
+		app.cursor += cursorModifier
+		return
+	case COMPONENT_ENVVAR:
+		app.environment = append(app.environment[:comp.index], app.environment[comp.index+1:]...)
+		app.cursor += cursorModifier
+		return
+	case COMPONENT_SEPARATOR:
+		app.showMessage("unable to delete %v: it is removed along with the arguments after it", DOUBLE_DASH)
+		return
+	case COMPONENT_VALUE:
+		for j, val := range comp.cmd.optValues {
+			if val == comp.val {
+				comp.cmd.deleteOptionValueAt(j)
+				break
+			}
+		}
+		app.cursor += cursorModifier
+		return
+	}
+
+	cmd := comp.cmd
+	cmdIndex := len(app.enabledCommands) - 1
+	for i, c := range app.enabledCommands {
+		if c == cmd {
+			cmdIndex = i
+		}
+	}
+
+	if cmdIndex != len(app.enabledCommands)-1 {
+		app.showMessage("unable to delete %v command: one or more subcommands are present", cmd.Name)
+		return
+	} else if len(cmd.optValues) > 0 {
+		app.showMessage("unable to delete %v command: options are present", cmd.Name)
+		return
+	} else if cmdIndex == 0 {
+		app.showMessage("nothing to delete")
+		return
+	}
+
+	app.enabledCommands = app.enabledCommands[:len(app.enabledCommands)-1]
+	app.cursor += cursorModifier
+}
+
+func (app *application) handlePrefixKey(key rune) {
+	found := (key == WRAPPER_KEY && len(app.cfg.Wrappers) > 0) ||
+		(key == GROUP_KEY && app.hasGroups())
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if opt.prefix == key {
+				found = true
+				break
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+
+	if app.lastPrefix != key {
+		if found {
+			app.showMessage(string(key))
+			app.lastPrefix = key
+		} else {
+			app.showMessage("%c is undefined", key)
+			app.lastPrefix = 0
+		}
+	} else {
+		app.showMessage("")
+		app.lastPrefix = 0
+	}
+}
+
+func (app *application) isWrapperEnabled(w *wrapper) bool {
+	for _, wv := range app.wrappers {
+		if wv.w == w {
+			return true
+		}
+	}
+	return false
+}
+
+// handleWrapperKey toggles the wrapper assigned to key. Wrappers that take
+// a value are prompted for it.
+func (app *application) handleWrapperKey(key rune) {
+	for _, w := range app.cfg.Wrappers {
+		if w.key != key {
+			continue
+		}
+
+		for i, wv := range app.wrappers {
+			if wv.w == w {
+				app.wrappers = append(app.wrappers[:i], app.wrappers[i+1:]...)
+				app.cursor--
+				return
+			}
+		}
+
+		if w.Value == nil {
+			app.wrappers = append(app.wrappers, &wrapperValue{w: w})
+			app.cursor++
+			return
+		}
+
+		app.readOptionValue(w.Value, func(ok bool, val string) {
+			if ok {
+				app.wrappers = append(app.wrappers, &wrapperValue{w: w, value: val})
+				app.cursor++
+			}
+		})
+		return
+	}
+
+	app.showMessage("%c%c is undefined", WRAPPER_KEY, key)
+}
+
+// hasGroups reports whether any of the enabled commands has groups that
+// can be collapsed (i.e. that are not menus).
+func (app *application) hasGroups() bool {
+	for _, cmd := range app.enabledCommands {
+		for _, g := range cmd.Groups {
+			if !g.isMenu() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleGroupKey collapses or expands the group assigned to key.
+func (app *application) handleGroupKey(key rune) {
+	for _, cmd := range app.enabledCommands {
+		for _, g := range cmd.Groups {
+			if g.key == key {
+				g.toggled = !g.toggled
+				return
+			}
+		}
+	}
+
+	app.showMessage("%c%c is undefined", GROUP_KEY, key)
+}
+
+func (app *application) handleNegativeKey() {
+	if app.lastPrefix != 0 {
+		app.showMessage("%c%c is undefined", app.lastPrefix, NEGATIVE_KEY)
+		app.lastPrefix = 0
+		app.negativeArg = false
+		return
+	}
+
+	app.negativeArg = !app.negativeArg
+	if app.negativeArg {
+		app.showMessage("%c (negative argument)", NEGATIVE_KEY)
+	}
+}
+
+// handleEnvvarKey prompts for an environment variable to set. When the
+// spec declares environment variables, the key works as a prefix for
+// their keys instead, and pressing it twice prompts for any variable.
+func (app *application) handleEnvvarKey() {
+	if app.lastPrefix == ENVVAR_KEY {
+		app.showMessage("")
+		app.lastPrefix = 0
+		app.promptEnvvar()
+		return
+	} else if app.lastPrefix != 0 {
+		app.showMessage("%c%c is undefined", app.lastPrefix, ENVVAR_KEY)
+		app.lastPrefix = 0
+		return
+	}
+
+	if len(app.sp.Command.Environment) > 0 {
+		app.showMessage(string(ENVVAR_KEY))
+		app.lastPrefix = ENVVAR_KEY
+		return
+	}
+
+	app.promptEnvvar()
+}
+
+// handleDeclaredEnvvarKey sets (or with the negative argument, removes)
+// the variable declared in the spec with key.
+func (app *application) handleDeclaredEnvvarKey(key rune) {
+	for _, decl := range app.sp.Command.Environment {
+		if decl.key != key {
+			continue
+		}
+
+		if app.negativeArg {
+			if !app.removeEnvvar(decl.Name) {
+				app.showMessage("%v is not set", decl.Name)
+			}
+			return
+		}
+
+		app.readEnvvarValue(decl.Name, decl)
+		return
+	}
+
+	app.showMessage("%c%c is undefined", ENVVAR_KEY, key)
+}
+
+func validateEnvvarName(text string) error {
+	match, err := regexp.MatchString(ENVVAR_NAME_PATTERN, strings.TrimPrefix(text, "-"))
+	if err != nil {
+		panic(err)
+	}
+
+	if !match {
+		return errors.New("invalid variable name")
+	}
+	return nil
+}
+
+// promptEnvvar reads the name of an environment variable, and then its
+// value. Names starting with "-" unset the variable instead.
+func (app *application) promptEnvvar() {
+	names := []string{}
+	seen := make(map[string]struct{})
+	addName := func(name string) {
+		if _, contained := seen[name]; !contained {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+
+	for _, decl := range app.sp.Command.Environment {
+		addName(decl.Name)
+	}
+	for _, kv := range os.Environ() {
+		name, _, _ := strings.Cut(kv, "=")
+		addName(name)
+	}
+	sort.Strings(names)
+
+	app.minibufferValidator = validateEnvvarName
+	app.minibufferRead("name:", func(ok bool, name string) {
+		if !ok {
+			return
+		}
+
+		if strings.HasPrefix(name, "-") {
+			name = strings.TrimPrefix(name, "-")
+			app.setEnvvar(&envvar{name: name, unset: true, decl: app.envDeclFor(name)})
+			return
+		}
+
+		app.readEnvvarValue(name, app.envDeclFor(name))
+	}, "", "NAME (or -NAME to unset)", names)
+}
+
+// readEnvvarValue reads the value of the variable name. If the variable
+// is already set for the command, its value is edited.
+func (app *application) readEnvvarValue(name string, decl *envDecl) {
+	default_ := ""
+	if ev := app.findEnvvar(name); ev != nil {
+		default_ = ev.value
+	}
+
+	completions := []string{}
+	if decl != nil {
+		completions = append(completions, decl.Completion.Values...)
+	}
+
+	current, set := os.LookupEnv(name)
+	secret := decl != nil && decl.Secret
+	if set && !secret {
+		completions = append(completions, current)
+	}
+
+	if secret {
+		app.ui.minibuffer.SetMaskCharacter('*')
+	}
+
+	app.minibufferRead(name+"=", func(ok bool, value string) {
+		if ok {
+			app.setEnvvar(&envvar{name: name, value: value, decl: decl})
+		}
+	}, default_, "", completions)
+}
+
+func (app *application) envDeclFor(name string) *envDecl {
+	for _, decl := range app.sp.Command.Environment {
+		if decl.Name == name {
+			return decl
+		}
+	}
+	return nil
+}
+
+func (app *application) findEnvvar(name string) *envvar {
+	for _, ev := range app.environment {
+		if ev.name == name {
+			return ev
+		}
+	}
+	return nil
+}
+
+// setEnvvar adds ev to the command, replacing the variable with the same
+// name if there is one. Unset variables are kept first, so that they can
+// all be passed to a single env command.
+func (app *application) setEnvvar(ev *envvar) {
+	added := true
+	for i, existing := range app.environment {
+		if existing.name == ev.name {
+			app.environment[i] = ev
+			added = false
+			break
+		}
+	}
+
+	if added {
+		app.environment = append(app.environment, ev)
+	}
+
+	sort.SliceStable(app.environment, func(i, j int) bool {
+		return app.environment[i].unset && !app.environment[j].unset
+	})
+
+	if !added {
+		return
+	}
+
+	for i, existing := range app.environment {
+		if existing == ev && len(app.wrappers)+i <= app.cursor {
+			app.cursor++
+		}
+	}
+}
+
+func (app *application) removeEnvvar(name string) bool {
+	for i, ev := range app.environment {
+		if ev.name == name {
+			app.environment = append(app.environment[:i], app.environment[i+1:]...)
+			// Only components before the cursor move it
+			if len(app.wrappers)+i < app.cursor {
+				app.cursor--
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// usesEnv reports whether the environment variables have to be passed to
+// env: either to unset some of them, or because the wrapper before them
+// would take an assignment as the command to run (like nice FOO=1 cmd).
+func (app *application) usesEnv() bool {
+	if len(app.environment) == 0 {
+		return false
+	} else if app.environment[0].unset {
+		// Unset variables are always first
+		return true
+	}
+	return len(app.wrappers) > 0 && !app.wrappers[len(app.wrappers)-1].w.Assignments
+}
+
+// envvarText returns the text for the i-th environment variable. When
+// the variables are passed to env, the first of them introduces it.
+func (app *application) envvarText(i int, masked bool) string {
+	text := app.environment[i].render(masked)
+	if i == 0 && app.usesEnv() {
+		text = "env " + text
+	}
+	return text
+}
+
+// openMenu shows only the options of the menu group g, giving them their
+// own keys.
+func (app *application) openMenu(cmd *subcommand, g *group) {
+	app.menu = g
+	app.menuCmd = cmd
+	app.showMessage("%v menu: ESC or Ctrl-G to return", g.Name)
+}
+
+func (app *application) closeMenu() {
+	app.menu = nil
+	app.menuCmd = nil
+}
+
+// handleShowAllKey toggles whether hidden subcommands and options are
+// shown (and given keys).
+func (app *application) handleShowAllKey() {
+	app.lastPrefix = 0
+	app.showAll = !app.showAll
+	if app.showAll {
+		app.showMessage("showing hidden subcommands and options")
+	} else {
+		app.showMessage("not showing hidden subcommands and options")
+	}
+}
+
+// warnStatus shows a warning when enabling a deprecated or experimental
+// subcommand or option, or one not available in the command's version.
+func (app *application) warnStatus(name string, deprecated string, experimental bool, since string, until string) {
+	if !app.isAvailable(since, until) {
+		app.showMessage("warning: %v is not available in version %v", name, app.version)
+	} else if deprecated != "" {
+		app.showMessage("warning: %v is deprecated: %v", name, deprecated)
+	} else if experimental {
+		app.showMessage("warning: %v is experimental", name)
+	}
+}
+
+func (app *application) enableCommand(cmd *subcommand) {
+	app.closeMenu()
+	app.warnStatus(cmd.Name, cmd.Deprecated, cmd.Experimental, cmd.Since, cmd.Until)
+	app.enabledCommands = append(app.enabledCommands, cmd)
+	app.cursor = math.MaxInt
+}
+
+func (app *application) handleLetterKeyNoPrefix(key rune) {
+	if app.menu != nil {
+		app.handleLetterDigitKeyWithPrefix(key)
+		return
+	}
+
+	for _, cmd := range app.enabledCommands {
+		for _, g := range cmd.Groups {
+			if g.isMenu() && g.menuKey() == key {
+				app.openMenu(cmd, g)
+				return
+			}
+		}
+	}
+
+	found := false
+	for _, cmd := range app.visibleCommands() {
+		if cmd.key == key {
+			app.enableCommand(cmd)
+			found = true
+			break
+		}
+	}
+
+	if !found {
+		app.showMessage("%c is undefined", key)
+	}
+}
+
+// enableCommandPath enables the subcommands named in path, one after the
+// other, starting from the root command. Aliases are accepted as well.
+func (app *application) enableCommandPath(path []string) error {
+	for i, name := range path {
+		found := false
+		// Hidden subcommands can be used as well
+		for _, cmd := range app.enabledCommands[len(app.enabledCommands)-1].Subcommands {
+			if cmd.hasName(name) {
+				app.enableCommand(cmd)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("subcommand not found: %v", strings.Join(path[:i+1], " "))
+		}
+	}
+
+	return nil
+}
+
+func (app *application) handleSearchKey() {
+	app.lastPrefix = 0
+
+	commands := app.visibleCommands()
+	if len(commands) == 0 {
+		app.showMessage("no subcommands to search")
+		return
+	}
+
+	// Each candidate includes the name, aliases and help of the
+	// subcommand, so that the search matches on any of them.
+	candidates := make([]string, 0, len(commands))
+	byCandidate := make(map[string]*subcommand)
+	for _, cmd := range commands {
+		candidate := cmd.Name
+		if len(cmd.Aliases) > 0 {
+			candidate += " (" + strings.Join(cmd.Aliases, ", ") + ")"
+		}
+		if cmd.Help != "" {
+			candidate += " - " + cmd.Help
+		}
+
+		candidates = append(candidates, candidate)
+		byCandidate[candidate] = cmd
+	}
+
+	app.minibufferSearch("subcommand:", func(ok bool, val string) {
+		if !ok {
+			return
+		}
+
+		cmd, found := byCandidate[val]
+		if !found {
+			for _, c := range commands {
+				if c.hasName(strings.TrimSpace(val)) {
+					cmd, found = c, true
+					break
+				}
+			}
+		}
+
+		if !found {
+			app.showMessage("no subcommand matches %v", val)
+			return
+		}
+
+		app.enableCommand(cmd)
+	}, candidates)
+}
+
+// fuzzyMatch reports whether all the characters of pattern appear in s,
+// in the same order (but not necessarily next to each other).
+func fuzzyMatch(s string, pattern string) bool {
+	for _, r := range pattern {
+		i := strings.IndexRune(s, r)
+		if i == -1 {
+			return false
+		}
+		s = s[i+utf8.RuneLen(r):]
+	}
+	return true
+}
+
+// handleFilterKey searches the options of all enabled commands by their
+// flags, metavar and help. The selected option is activated as if its
+// keys had been pressed.
+func (app *application) handleFilterKey() {
+	if app.lastPrefix != 0 {
+		app.showMessage("%c%c is undefined", app.lastPrefix, FILTER_KEY)
+		app.lastPrefix = 0
+		return
+	}
+
+	type match struct {
+		cmd *subcommand
+		opt *option
+	}
+
+	candidates := []string{}
+	byCandidate := make(map[string]match)
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if !app.isOptionShown(opt) {
+				continue
+			}
+
+			candidate := opt.keySequence() + "  "
+			if opt.isFlag() {
+				candidate += strings.Join(opt.Flags, ", ")
+				if opt.getType() != FLAG_TYPE_TOGGLE && !opt.isCount() {
+					candidate += " <" + opt.metavar() + ">"
+				}
+			} else {
+				candidate += opt.name()
+			}
+
+			if opt.Help != "" {
+				candidate += " - " + opt.Help
+			}
+			if len(app.enabledCommands) > 1 {
+				candidate += " (" + cmd.Name + ")"
+			}
+
+			candidates = append(candidates, candidate)
+			byCandidate[candidate] = match{cmd, opt}
+		}
+	}
+
+	if len(candidates) == 0 {
+		app.showMessage("no options to filter")
+		return
+	}
+
+	app.minibufferFilter = fuzzyMatch
+	app.minibufferRead("option:", func(ok bool, val string) {
+		if !ok {
+			app.negativeArg = false
+			return
+		}
+
+		m, found := byCandidate[val]
+		if !found {
+			// Accept the typed text when it matches a single option
+			matches := []string{}
+			for _, candidate := range candidates {
+				if fuzzyMatch(strings.ToLower(candidate), strings.ToLower(val)) {
+					matches = append(matches, candidate)
+				}
+			}
+
+			if len(matches) != 1 {
+				app.showMessage("%v options match %v", len(matches), val)
+				app.negativeArg = false
+				return
+			}
+			m = byCandidate[matches[0]]
+		}
+
+		app.activateOption(m.cmd, m.opt)
+	}, "", "flag, metavar or help", candidates)
+}
+
+func (app *application) handleDigitKeyNoPrefix(key rune) {
+	found := false
+
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if !opt.isArgument() {
+				continue
+			}
+
+			if opt.key == key {
+				app.activateOption(cmd, opt)
+				found = true
+				break
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+
+	if !found {
+		app.showMessage("%c is undefined", key)
+	}
+}
+
+// activateOption is invoked when the key for an option is pressed. It
+// either enables the option (adding one more value, if repeatable), or
+// disables it.
+func (app *application) activateOption(cmd *subcommand, opt *option) {
+	negative := app.negativeArg
+	app.negativeArg = false
+
+	if negative {
+		// With a negative argument, count flags are decremented and any
+		// other option is disabled.
+		if opt.isCount() && cmd.isOptionEnabled(opt) {
+			app.changeCount(cmd, opt, -1)
+		} else {
+			cmd.deleteOptionValuesFor(opt)
+		}
+		return
+	}
+
+	if opt.isChoice() && cmd.isOptionEnabled(opt) {
+		app.cycleChoice(cmd, opt)
+		return
+	}
+
+	if val := cmd.optionValueFor(opt); opt.List && !opt.isRepeatable() && val != nil {
+		app.editListValue(cmd, val)
+		return
+	}
+
+	if val := cmd.optionValueFor(opt); val != nil && val.nested != nil && !opt.isRepeatable() {
+		app.editNestedCommand(val)
+		return
+	}
+
+	if val := cmd.optionValueFor(opt); opt.isNegatable() && val != nil && val.flag == "" {
+		// Cycle from --foo to --no-foo, and then to unset.
+		val.flag = opt.negatedFlag()
+		return
+	}
+
+	if cmd.isOptionEnabled(opt) && !opt.isRepeatable() && !opt.isCount() {
+		cmd.deleteOptionValuesFor(opt)
+		return
+	}
+
+	max := opt.maxOccurs()
+	if max > 0 && cmd.countOptionValues(opt) >= max {
+		app.showMessage("%v can be used at most %v times", opt.name(), max)
+		return
+	}
+
+	if opt.isCount() && cmd.isOptionEnabled(opt) {
+		app.changeCount(cmd, opt, 1)
+		return
+	}
+
+	conflicts := app.conflictingOptions(opt)
+	if len(conflicts) == 0 {
+		app.enableOption(cmd, opt)
+		return
+	}
+
+	prompt := fmt.Sprintf("%v conflicts with %v, replace? (y/n)", opt.name(), optionNames(conflicts))
+	app.minibufferConfirm(prompt, func() {
+		for _, other := range conflicts {
+			for _, c := range app.enabledCommands {
+				c.deleteOptionValuesFor(other)
+			}
+		}
+		app.enableOption(cmd, opt)
+	})
+}
+
+func (app *application) enableOption(cmd *subcommand, opt *option) {
+	app.warnStatus(opt.name(), opt.Deprecated, opt.Experimental, opt.Since, opt.Until)
+
+	if opt.isChoice() {
+		app.cycleChoice(cmd, opt)
+	} else if opt.isCount() {
+		app.addOptionValue(cmd, opt, "1", "")
+	} else if opt.isFlag() && opt.getType() == FLAG_TYPE_TOGGLE {
+		app.addOptionValue(cmd, opt, "", "")
+	} else if opt.isArgument() && opt.Command {
+		app.promptNestedCommand(cmd, opt)
+	} else {
+		app.promptOptionValue(cmd, opt)
+	}
+}
+
+// editListValue re-opens the minibuffer for a list option's value, with
+// its current items already selected. Removing all of them disables the
+// option.
+func (app *application) editListValue(cmd *subcommand, val *optionValue) {
+	app.readOptionValueWithDefault(val.opt, val.value, func(ok bool, text string) {
+		if !ok {
+			return
+		}
+
+		if text == "" {
+			cmd.deleteOptionValuesFor(val.opt)
+			return
+		}
+		val.value = text
+	})
+}
+
+// changeCount adds delta to the value of a count flag. The flag is
+// disabled once the count reaches zero.
+func (app *application) changeCount(cmd *subcommand, opt *option, delta int) {
+	val := cmd.optionValueFor(opt)
+	n := cmd.countOptionValues(opt) + delta
+	if n <= 0 {
+		cmd.deleteOptionValuesFor(opt)
+		return
+	}
+
+	val.value = strconv.Itoa(n)
+}
+
+// cycleChoice sets the value of a choice option to the next one in its
+// list of choices. After the last choice, the option is disabled.
+func (app *application) cycleChoice(cmd *subcommand, opt *option) {
+	flag := func(choice string) string {
+		if opt.isTemplate() {
+			return opt.expandTemplate(choice)
+		}
+		return ""
+	}
+
+	val := cmd.optionValueFor(opt)
+	if val == nil {
+		app.addOptionValue(cmd, opt, opt.Choices[0], flag(opt.Choices[0]))
+		return
+	}
+
+	for i, choice := range opt.Choices {
+		if choice == val.value && i+1 < len(opt.Choices) {
+			val.value = opt.Choices[i+1]
+			val.flag = flag(val.value)
+			return
+		}
+	}
+
+	cmd.deleteOptionValuesFor(opt)
+}
+
+// queueRequirements adds the options required by opt which are not
+// enabled yet to the front of app.pendingRequirements.
+func (app *application) queueRequirements(opt *option) {
+	missing := []*option{}
+	for _, ref := range opt.Requires {
+		cmd, required := app.findOption(ref)
+		if required == nil {
+			app.showMessage("%v requires %v, which is not available", opt.name(), ref)
+			continue
+		}
+
+		if !cmd.isOptionEnabled(required) {
+			missing = append(missing, required)
+		}
+	}
+
+	app.pendingRequirements = append(missing, app.pendingRequirements...)
+}
+
+// enableRequirements enables the options in app.pendingRequirements, one
+// by one. When an option needs a value, the user is prompted for it and
+// the rest of the requirements are handled once it has been entered.
+func (app *application) enableRequirements() {
+	for len(app.pendingRequirements) > 0 {
+		opt := app.pendingRequirements[0]
+		app.pendingRequirements = app.pendingRequirements[1:]
+
+		cmd := app.commandFor(opt)
+		if cmd.isOptionEnabled(opt) && !opt.isRepeatable() {
+			continue
+		}
+
+		app.enableOption(cmd, opt)
+		if app.minibufferActive {
+			return
+		}
+	}
+}
+
+func (app *application) promptOptionValue(cmd *subcommand, opt *option) {
+	if opt.isFlag() && opt.isTemplate() {
+		// Handle flags like --validate-<thing> (template)
+		app.minibufferRead("flag:", func(ok bool, val string) {
+			if !ok || !strings.HasPrefix(val, "-") {
+				app.pendingRequirements = nil
+				return
+			}
+
+			app.readOptionValue(opt, func(ok bool, val2 string) {
+				if ok {
+					app.addOptionValue(cmd, opt, val2, val)
+				} else {
+					app.pendingRequirements = nil
+				}
+			})
+
+		}, opt.longFlag(), "", nil)
+
+		return
+	}
+
+	app.readOptionValue(opt, func(ok bool, val string) {
+		if ok && opt.List && val == "" {
+			app.pendingRequirements = nil
+		} else if ok {
+			app.addOptionValue(cmd, opt, val, "")
+		} else {
+			app.pendingRequirements = nil
+		}
+	})
+}
+
+// insertionIndex returns the index in cmd's values at which new values
+// should be inserted, according to the cursor. When the cursor is not on
+// one of cmd's components, -1 is returned.
+func (app *application) insertionIndex(cmd *subcommand) int {
+	comps := app.components()
+	if app.cursor >= len(comps) || comps[app.cursor].cmd != cmd {
+		return -1
+	}
+
+	comp := comps[app.cursor]
+	switch comp.kind {
+	case COMPONENT_COMMAND:
+		return 0
+	case COMPONENT_SEPARATOR:
+		// The separator is always followed by one of the command's values
+		comp = comps[app.cursor+1]
+	}
+
+	for i, val := range cmd.optValues {
+		if val == comp.val {
+			return i
+		}
+	}
+	return -1
+}
+
+// componentIndex returns the index of val among the command's components.
+func (app *application) componentIndex(val *optionValue) int {
+	for i, comp := range app.components() {
+		if comp.val == val {
+			return i
+		}
+	}
+	return -1
+}
+
+// handleMoveKey moves the value under the cursor one place to the left or
+// to the right, among the values of its command.
+func (app *application) handleMoveKey(left bool) {
+	app.lastPrefix = 0
+
+	comps := app.components()
+	if app.cursor >= len(comps) || comps[app.cursor].kind != COMPONENT_VALUE {
+		app.showMessage("only values can be moved")
+		return
+	}
+
+	comp := comps[app.cursor]
+	for i, val := range comp.cmd.optValues {
+		if val != comp.val {
+			continue
+		}
+
+		if err := comp.cmd.moveOptionValue(i, left); err != nil {
+			app.showMessage("%v: %v", val.opt.name(), err)
+			return
+		}
+		break
+	}
+
+	// Keep the cursor on the moved value
+	app.cursor = app.componentIndex(comp.val)
+}
+
+// handleEditKey edits the value of the component under the cursor,
+// keeping its position in the command.
+func (app *application) handleEditKey() {
+	app.lastPrefix = 0
+
+	if app.cursor >= app.cursorMax {
+		app.showMessage("nothing to edit")
+		return
+	}
+
+	comp := app.components()[app.cursor]
+
+	switch comp.kind {
+	case COMPONENT_WRAPPER:
+		wv := app.wrappers[comp.index]
+		if wv.w.Value == nil {
+			app.showMessage("%v takes no value", wv.w.Name)
+			return
+		}
+
+		app.readOptionValueWithDefault(wv.w.Value, wv.value, func(ok bool, val string) {
+			if ok {
+				wv.value = val
+			}
+		})
+	case COMPONENT_ENVVAR:
+		ev := app.environment[comp.index]
+		if ev.unset {
+			app.showMessage("%v is unset, it has no value", ev.name)
+			return
+		}
+		app.readEnvvarValue(ev.name, ev.decl)
+	case COMPONENT_VALUE:
+		app.editOptionValue(comp.cmd, comp.val)
+	default:
+		app.showMessage("only values can be edited")
+	}
+}
+
+// editOptionValue prompts for a new value for val, pre-filled with the
+// current one. Template flags are prompted for as well.
+func (app *application) editOptionValue(cmd *subcommand, val *optionValue) {
+	opt := val.opt
+
+	if val.nested != nil {
+		app.editNestedCommand(val)
+		return
+	} else if opt.List {
+		app.editListValue(cmd, val)
+		return
+	} else if opt.isCount() {
+		app.showMessage("press the keys of %v to change it (or %c before them to decrement it)", opt.name(), NEGATIVE_KEY)
+		return
+	} else if opt.isNegatable() {
+		if val.flag == "" {
+			val.flag = opt.negatedFlag()
+		} else {
+			val.flag = ""
+		}
+		return
+	} else if opt.isFlag() && opt.getType() == FLAG_TYPE_TOGGLE {
+		app.showMessage("%v takes no value", opt.name())
+		return
+	}
+
+	readValue := func(flag string) {
+		app.readOptionValueWithDefault(opt, val.value, func(ok bool, text string) {
+			if !ok {
+				return
+			}
+
+			val.value = text
+			if opt.isChoice() && opt.isTemplate() {
+				val.flag = opt.expandTemplate(text)
+			} else {
+				val.flag = flag
+			}
+		})
+	}
+
+	if opt.isFlag() && opt.isTemplate() && !opt.isChoice() {
+		app.minibufferRead("flag:", func(ok bool, flag string) {
+			if ok && strings.HasPrefix(flag, "-") {
+				readValue(flag)
+			}
+		}, val.flag, "", nil)
+		return
+	}
+
+	readValue(val.flag)
+}
+
+func (app *application) addOptionValue(cmd *subcommand, opt *option, val string, flag string) *optionValue {
+	value := &optionValue{opt: opt, value: val, flag: flag}
+	at := app.insertionIndex(cmd)
+	cmd.insertOptionValue(value, at)
+
+	// Place the cursor after the new value, which may not be the last
+	// component (e.g. arguments are kept in their spec order)
+	app.cursor = app.componentIndex(value) + 1
+
+	app.queueRequirements(opt)
+	app.enableRequirements()
+	return value
+}
+
+func (app *application) handleLetterDigitKeyWithPrefix(key rune) {
+	found := false
+
+	for _, cmd := range app.enabledCommands {
+		for _, opt := range cmd.Options {
+			if !opt.isFlag() {
+				continue
+			}
+
+			if opt.prefix == app.lastPrefix && opt.key == key {
+				app.activateOption(cmd, opt)
+				found = true
+				break
+			}
+		}
+
+		if found {
+			break
+		}
+	}
+
+	if !found && app.lastPrefix == 0 {
+		// Flags in menus have no prefix
+		app.showMessage("%c is undefined", key)
+	} else if !found {
+		app.showMessage("%c%c is undefined", app.lastPrefix, key)
+	}
+}
+
+func (app *application) handleLetterDigitKey(key rune) {
+	if app.lastPrefix == 0 {
+		if strings.ContainsRune(LETTERS, key) {
+			app.handleLetterKeyNoPrefix(key)
+		} else {
+			app.handleDigitKeyNoPrefix(key)
+		}
+	} else if app.lastPrefix == WRAPPER_KEY {
+		app.handleWrapperKey(key)
+	} else if app.lastPrefix == ENVVAR_KEY {
+		app.handleDeclaredEnvvarKey(key)
+	} else if app.lastPrefix == GROUP_KEY {
+		app.handleGroupKey(key)
+	} else {
+		app.handleLetterDigitKeyWithPrefix(key)
+	}
+	app.lastPrefix = 0
+	app.negativeArg = false
+}
+
+// keepsNegativeArg reports whether a key pressed after the negative
+// argument leaves it in place for the keys that follow, like prefixes do.
+func keepsNegativeArg(event *tcell.EventKey) bool {
+	if event.Key() != tcell.KeyRune {
+		return false
+	}
+
+	key := event.Rune()
+	return isPrefix(key) || key == ENVVAR_KEY || key == FILTER_KEY
+}
+
+func (app *application) handlePrintableKey(key rune) {
+	if isPrefix(key) || key == WRAPPER_KEY || key == GROUP_KEY {
+		app.handlePrefixKey(key)
+	} else if key == ENVVAR_KEY {
+		app.handleEnvvarKey()
+	} else if key == NEGATIVE_KEY {
+		app.handleNegativeKey()
+	} else if strings.ContainsRune(LETTERS+DIGITS, key) {
+		app.handleLetterDigitKey(key)
+	} else if key == HELP_KEY {
+		app.handleHelpKey()
+	} else if key == FILTER_KEY {
+		app.handleFilterKey()
+	} else {
+		app.showMessage("%c is undefined", key)
+	}
+}
+
+func (app *application) handlePagination(pages *tview.Pages, up bool) {
+	front, _ := pages.GetFrontPage()
+	count := pages.GetPageCount()
+
+	index, _ := strconv.Atoi(front)
+	if up {
+		index--
+	} else {
+		index++
+	}
+
+	if index < 0 {
+		index = 0
+	} else if index > count-1 {
+		index = count - 1
+	}
+
+	pages.SwitchToPage(strconv.Itoa(index))
+}
+
+func (app *application) handleHelpKey() {
+	// Allow using the help key even if a prefix key was active,
+	// for convenience.
+	app.lastPrefix = 0
+	app.helpActive = true
+	app.ui.root.AddItem(app.ui.helpModal, 0, 0, true)
+}
+
+func (app *application) handleHelpClose() {
+	app.ui.root.RemoveItem(app.ui.helpModal)
+	app.helpActive = false
+	app.tviewApp.SetFocus(app.ui.root)
+}
+
+// handleEnterKey finishes editing the command. If some options are
+// still missing values, the user is asked to press ENTER a second time.
+func (app *application) handleEnterKey() {
+	missing := app.missingOptions()
+	if len(missing) > 0 && !app.confirmFinish {
+		app.showMessage("missing %v (ENTER to finish anyway, TAB to fill in)", optionNames(dedupOptions(missing)))
+		app.confirmFinish = true
+		return
+	}
+
+	if app.parent != nil {
+		app.closeNested(true)
+		return
+	}
+
+	app.onCloseCallback = app.handleFinishEditing
+	app.tviewApp.Stop()
+}
+
+// availableSpecs returns the names of the commands that have a spec in
+// the spec search path.
+func availableSpecs() []string {
+	names := []string{}
+	seen := make(map[string]struct{})
+	for _, dir := range specSearchPath() {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			name, found := strings.CutSuffix(entry.Name(), SPEC_EXTENSION)
+			if _, ok := seen[name]; found && !ok {
+				seen[name] = struct{}{}
+				names = append(names, name)
 			}
 		}
-		cmdText.nl()
 	}
 
-	app.ui.subcommandsTextView.SetText(cmdText.page(0))
+	sort.Strings(names)
+	return names
 }
 
-func (app *application) currentCommand() string {
-	return strings.TrimSpace(app.ui.cmdPreviewTextView.GetText(true))
-}
+// promptNestedCommand asks for the name of the command to build for a
+// command argument, and opens a nested session for it.
+func (app *application) promptNestedCommand(cmd *subcommand, opt *option) {
+	app.minibufferRead("command:", func(ok bool, name string) {
+		if !ok || name == "" {
+			app.pendingRequirements = nil
+			return
+		}
 
-func (app *application) updateCmdPreviewView() {
-	previewText := NewUIText(false, 0)
-	regionN := 0
+		path, err := findSpec(name)
+		if err != nil {
+			app.showMessage("%v", err)
+			return
+		}
 
-	for i, env := range app.environment {
-		if i > 0 {
-			previewText.write(" ")
+		sp, err := loadSpec(path)
+		if err != nil {
+			app.showMessage("%v", err)
+			return
 		}
-		previewText.write(regionInt(regionN, env))
-		regionN++
-	}
 
-	for i, cmd := range app.enabledCommands {
-		if i > 0 || len(app.environment) > 0 {
-			previewText.write(" ")
+		nested := newApplication(sp, app.cfg, app.tviewApp)
+		nested.parent = app
+		// The user can't be asked while the interface is shown, so the
+		// version is only detected if the command was trusted before
+		// (otherwise, the spec's version is used).
+		nested.version, _ = detectVersion(sp, path, false)
+		nested.onNestedFinish = func(command string) {
+			val := app.addOptionValue(cmd, opt, command, "")
+			val.nested = nested
 		}
+		nested.show()
+	}, opt.Default, "command name or file", availableSpecs())
+}
 
-		previewText.write(regionInt(regionN, cmd.Name))
-		regionN++
+// editNestedCommand re-opens the nested session in which the value of a
+// command argument was built.
+func (app *application) editNestedCommand(val *optionValue) {
+	val.nested.onNestedFinish = func(command string) {
+		val.value = command
+	}
+	val.nested.show()
+}
 
-		for _, val := range cmd.optValues {
-			opt := val.opt
-			valuePreview := val.value
+// closeNested returns to the parent session. If ok is true, the command
+// built in this session is passed on to it.
+func (app *application) closeNested(ok bool) {
+	if ok {
+		app.onNestedFinish(app.currentCommand())
+	}
+	app.parent.show()
+}
 
-			if opt.Quoting == QUOTING_SINGLE {
-				valuePreview = "'" + valuePreview + "'"
-			} else if opt.Quoting == QUOTING_DOUBLE {
-				valuePreview = "\"" + valuePreview + "\""
-			} else if valuePreview == "" {
-				// Quote empty values using double quotes, by default
-				valuePreview = "\"\""
-			}
+// handleMissingKey prompts for the values of all the missing options, one
+// after the other.
+func (app *application) handleMissingKey() {
+	app.lastPrefix = 0
 
-			if opt.isFlag() {
-				flagText := opt.mainFlag()
-				if val.flag != "" {
-					flagText = val.flag
-				}
+	missing := app.missingOptions()
+	if len(missing) == 0 {
+		app.showMessage("nothing is missing")
+		return
+	}
 
-				if opt.FlagType == FLAG_TYPE_TOGGLE ||
-					(opt.FlagType == FLAG_TYPE_VALUE_OPTIONAL && val.value == "") {
-					previewText.write(" " + regionInt(regionN, flagText))
-				} else {
-					sep := " "
-					if opt.Separator != "" {
-						sep = opt.Separator
-					}
-					previewText.write(" " + regionInt(regionN, flagText+sep+valuePreview))
-				}
-			} else {
-				previewText.write(" " + regionInt(regionN, valuePreview))
+	app.pendingRequirements = missing
+	app.enableRequirements()
+}
 
-			}
-			regionN++
-		}
+func (app *application) handleFinishEditing() {
+	command := app.currentCommand()
+	fmt.Println(command)
+
+	if !clipboard.Unsupported {
+		clipboard.WriteAll(command)
+		fmt.Println("(copied to clipboard)")
 	}
+}
 
-	// Cursor can move one extra place to the right
-	previewText.write(" " + regionInt(regionN, " "))
+func (app *application) initialize() {
+	app.initialized = true
+	hint := fmt.Sprintf("press %c for help, Ctrl-C to exit, ENTER to finish editing", HELP_KEY)
+	if app.parent != nil {
+		hint = fmt.Sprintf("press %c for help, ESC to cancel, ENTER to return to %v", HELP_KEY, app.parent.sp.Command.Name)
+	}
 
-	app.ui.cmdPreviewTextView.SetText(previewText.page(0))
-	app.ui.cmdPreviewTextView.Highlight(strconv.Itoa(app.cursor))
+	if len(app.sp.warnings) > 0 {
+		app.showMessage("warning: %v; %v", strings.Join(app.sp.warnings, "; "), hint)
+		return
+	}
+	app.showMessage("%v", hint)
 }
 
-func (app *application) updateOptionsTitle() {
-	front, _ := app.ui.optionsPages.GetFrontPage()
-	i, _ := strconv.Atoi(front)
-	count := app.ui.optionsPages.GetPageCount()
-	app.ui.optionsFlex.SetTitle(fmt.Sprintf("Options (page %v of %v)", i+1, count))
-}
+func (app *application) captureRootInput(event *tcell.EventKey) *tcell.EventKey {
+	if app.minibufferActive {
+		return event
+	} else if app.helpActive {
+		app.handleHelpClose()
+		return nil
+	}
 
-func (app *application) updateOptionsView() {
-	_, _, _, pagesHeight := app.ui.optionsPages.GetRect()
-	front, _ := app.ui.optionsPages.GetFrontPage()
-	optsText := NewUIText(true, pagesHeight)
+	app.showMessage("")
 
-	for i, cmd := range app.enabledCommands {
-		if i > 0 && len(cmd.Options) == 0 {
-			continue
-		}
+	if event.Key() != tcell.KeyEnter {
+		app.confirmFinish = false
+	}
 
-		optsText.bold().write(cmd.Name + ":").nl().unbold()
+	negativeArg := app.negativeArg
 
-		if i == 0 {
-			if app.lastPrefix != 0 {
-				optsText.dim()
-			}
-			optsText.color(KEY_COLOR).bold()
-			optsText.write("  " + string(ENVVAR_KEY))
-			optsText.nocolor().unbold()
-			optsText.write("  Add environment variable").nl()
-			optsText.reset()
+	switch key := event.Key(); key {
+	case CANCEL_KEY:
+		if app.menu != nil && app.lastPrefix == 0 && !app.negativeArg {
+			app.closeMenu()
+		}
+		app.lastPrefix = 0
+		app.negativeArg = false
+	case tcell.KeyEscape:
+		if app.menu != nil {
+			app.closeMenu()
+		} else if app.parent != nil {
+			app.closeNested(false)
+		}
+	case SEARCH_KEY:
+		app.handleSearchKey()
+	case SHOW_ALL_KEY:
+		app.handleShowAllKey()
+	case EDIT_KEY:
+		app.handleEditKey()
+	case tcell.KeyBackspace:
+		fallthrough
+	case tcell.KeyBackspace2:
+		fallthrough
+	case tcell.KeyDelete:
+		app.handleDeletionKey(key != tcell.KeyDelete)
+	case tcell.KeyEnter:
+		app.handleEnterKey()
+	case MISSING_KEY:
+		app.handleMissingKey()
+	case tcell.KeyLeft:
+		fallthrough
+	case tcell.KeyRight:
+		if event.Modifiers()&tcell.ModShift != 0 {
+			app.handleMoveKey(key == tcell.KeyLeft)
+		} else if key == tcell.KeyLeft {
+			app.cursor--
+		} else {
+			app.cursor++
 		}
+	case tcell.KeyUp:
+		fallthrough
+	case tcell.KeyDown:
+		app.handlePagination(app.ui.optionsPages, key == tcell.KeyUp)
+	case tcell.KeyPgUp:
+		fallthrough
+	case tcell.KeyPgDn:
+		app.handlePagination(app.ui.subcommandsPages, key == tcell.KeyPgUp)
+	case tcell.KeyRune:
+		app.handlePrintableKey(event.Rune())
+	}
 
-		for _, opt := range cmd.Options {
-			if !opt.isFlag() {
-				continue
-			}
+	// The negative argument only applies to the keys typed right after
+	// it, so any other key discards it.
+	if negativeArg && !keepsNegativeArg(event) {
+		app.negativeArg = false
+	}
 
-			dim := (app.lastPrefix != 0 && opt.prefix != app.lastPrefix)
-			flags := strings.Join(opt.Flags, ", ")
+	app.clampCursor()
+	app.updateKeys()
+	app.updateViews()
 
-			if dim {
-				optsText.dim()
-			}
+	if !app.initialized {
+		app.initialize()
+	}
 
-			optsText.color(KEY_COLOR)
-			optsText.bold().write(" " + string(opt.prefix) + string(opt.key)).unbold()
-			optsText.nocolor()
-			optsText.write("  " + opt.Help)
+	return nil
+}
 
-			if cmd.isOptionEnabled(opt) {
-				optsText.italic().color(ARG_ON_COLOR)
-			}
+func (app *application) clampCursor() {
+	app.cursorMax = len(app.components())
+
+	if app.cursor > app.cursorMax {
+		app.cursor = app.cursorMax
+	} else if app.cursor < 0 {
+		app.cursor = 0
+	}
+}
 
-			optsText.dim().write(" (" + flags)
+func (app *application) captureMinibufferInput(event *tcell.EventKey) *tcell.EventKey {
+	if event.Key() == CANCEL_KEY {
+		return tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone)
+	}
+	return event
+}
 
-			metavar := "value"
-			if opt.Metavar != "" {
-				metavar = opt.Metavar
-			}
+// configDir returns the directory containing brief's configuration, or
+// the empty string if it could not be determined.
+func configDir() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "brief")
+}
 
-			sep := " "
-			if opt.Separator != "" {
-				sep = opt.Separator
-			}
+// loadConfig reads the user's configuration file. A missing file is not
+// an error, and results in the default configuration.
+func loadConfig() (*config, error) {
+	cfg := config{}
 
-			switch opt.getType() {
-			case FLAG_TYPE_VALUE:
-				optsText.write(sep)
-				optsText.write("<" + metavar + ">)")
-			case FLAG_TYPE_VALUE_OPTIONAL:
-				// The string to display is "[$metavar]", but an extra "[" needs to be
-				// added in order to prevent tview from interpreting it as a color tag.
-				optsText.write(sep)
-				optsText.write("[" + metavar + "[])")
-			case FLAG_TYPE_TOGGLE:
-				optsText.write(")")
-			}
+	var data []byte
+	var err error
+	if dir := configDir(); dir != "" {
+		data, err = os.ReadFile(filepath.Join(dir, CONFIG_FILE))
+	}
 
-			if opt.Repeatable {
-				// See comment above
-				optsText.write(" [repeatable[]")
-			}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("unable to read config file: %w", err)
+	}
 
-			optsText.reset().nl()
-		}
+	err = yaml.Unmarshal(data, &cfg)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal config file: %w", err)
+	}
 
-		for _, opt := range cmd.Options {
-			if !opt.isArgument() {
-				continue
-			}
+	if cfg.Wrappers == nil {
+		cfg.Wrappers = defaultWrappers()
+	}
 
-			if app.lastPrefix != 0 {
-				optsText.dim()
-			}
+	for _, w := range cfg.Wrappers {
+		// Wrapper values are always rendered like arguments
+		if w.Value != nil && w.Value.Argument == "" {
+			w.Value.Argument = "value"
+		}
+	}
 
-			metavar := "value"
-			if opt.Metavar != "" {
-				metavar = opt.Metavar
-			}
+	return &cfg, nil
+}
 
-			optsText.color(KEY_COLOR).bold().write("  " + string(opt.key)).unbold().nocolor()
-			optsText.write("  " + opt.Help)
+// trustedCommand is a command which the user allowed a spec to run.
+type trustedCommand struct {
+	Spec    string   `yaml:"spec"`
+	Command []string `yaml:"command"`
+}
 
-			if cmd.isOptionEnabled(opt) {
-				optsText.italic().color(ARG_ON_COLOR)
-			}
+func trustFilePath() string {
+	dir := configDir()
+	if dir == "" {
+		return ""
+	}
+	return filepath.Join(dir, TRUST_FILE)
+}
 
-			optsText.dim().write(" (<" + metavar + ">)")
+func loadTrusted() []trustedCommand {
+	trusted := []trustedCommand{}
+	path := trustFilePath()
+	if path == "" {
+		return trusted
+	}
 
-			if opt.Repeatable {
-				optsText.write(" [repeatable[]")
-			}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return trusted
+	}
 
-			optsText.reset().nl()
-		}
+	// An invalid file just means nothing is trusted
+	_ = yaml.Unmarshal(data, &trusted)
+	return trusted
+}
 
-		if i < len(app.enabledCommands)-1 {
-			optsText.nl()
+// isTrusted reports whether the spec at specPath can run command.
+func isTrusted(specPath string, command []string) bool {
+	for _, tc := range loadTrusted() {
+		if tc.Spec == specPath && strings.Join(tc.Command, "\x00") == strings.Join(command, "\x00") {
+			return true
 		}
 	}
+	return false
+}
 
-	count := app.ui.optionsPages.GetPageCount()
-	for i := 0; i < count; i++ {
-		app.ui.optionsPages.RemovePage(strconv.Itoa(i))
+// trust remembers that the spec at specPath can run command.
+func trust(specPath string, command []string) error {
+	path := trustFilePath()
+	if path == "" {
+		return errors.New("unable to find the config directory")
 	}
 
-	for i := 0; i < optsText.pagesCount(); i++ {
-		view := tview.NewTextView()
-		view.SetDynamicColors(true)
-		view.SetWrap(false)
-		view.SetText(optsText.page(i))
-
-		app.ui.optionsPages.AddPage(strconv.Itoa(i), view, true, true)
+	trusted := append(loadTrusted(), trustedCommand{Spec: specPath, Command: command})
+	data, err := yaml.Marshal(trusted)
+	if err != nil {
+		return err
 	}
 
-	if app.ui.optionsPages.HasPage(front) {
-		app.ui.optionsPages.SwitchToPage(front)
-	} else {
-		app.ui.optionsPages.SwitchToPage("0")
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
 	}
+	return os.WriteFile(path, data, 0o644)
 }
 
-func (app *application) updateViews() {
-	app.updateSubcommandsView()
-	app.updateOptionsView()
-	app.updateOptionsTitle()
-	app.updateCmdPreviewView()
-}
+// askTrust asks the user, on the terminal, whether the spec at specPath
+// can run command.
+func askTrust(specPath string, command []string) bool {
+	fmt.Fprintf(os.Stderr, "%v wants to run \"%v\" to detect the installed version.\nAllow it? [y/N] ",
+		specPath, strings.Join(command, " "))
 
-func (app *application) handleDeletionKey(backspace bool) {
-	app.lastPrefix = 0
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.HasPrefix(strings.ToLower(strings.TrimSpace(answer)), "y")
+}
 
-	if (app.cursor >= app.cursorMax && !backspace) || (app.cursor <= 0 && backspace) {
-		app.showMessage("nothing to delete")
-		return
+// detectVersion runs the spec's version command, and finds the version in
+// its output. The command is only run if the user trusts it. When ask is
+// true, the user is asked (only once) if it hasn't been trusted yet. If
+// the version can't be detected, the version the spec describes (if any)
+// is returned instead.
+func detectVersion(sp *spec, specPath string, ask bool) (string, error) {
+	command := sp.Command.VersionCommand
+	if len(command) == 0 {
+		return sp.Command.Version, nil
 	}
 
-	deleteAt := app.cursor
-	cursorModifier := 0
-	if backspace {
-		deleteAt--
-		cursorModifier = -1
+	specPath, err := filepath.Abs(specPath)
+	if err != nil {
+		return sp.Command.Version, err
 	}
 
-	i := 0
+	if !isTrusted(specPath, command) {
+		if !ask || !askTrust(specPath, command) {
+			return sp.Command.Version, nil
+		}
 
-	for range app.environment {
-		if i == deleteAt {
-			app.environment = append(app.environment[:i], app.environment[i+1:]...)
-			app.cursor += cursorModifier
-			return
+		err = trust(specPath, command)
+		if err != nil {
+			return sp.Command.Version, fmt.Errorf("unable to save trusted command: %w", err)
 		}
+	}
 
-		i++
+	pattern := sp.Command.VersionPattern
+	if pattern == "" {
+		pattern = DEFAULT_VERSION_PATTERN
 	}
 
-	for cmdIndex, cmd := range app.enabledCommands {
-		if i == deleteAt {
-			if cmdIndex != len(app.enabledCommands)-1 {
-				app.showMessage("unable to delete %v command: one or more subcommands are present", cmd.Name)
-				return
-			} else if len(cmd.optValues) > 0 {
-				app.showMessage("unable to delete %v command: options are present", cmd.Name)
-				return
-			} else if cmdIndex == 0 {
-				app.showMessage("nothing to delete")
-				return
-			}
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return sp.Command.Version, fmt.Errorf("invalid version pattern: %w", err)
+	}
 
-			app.enabledCommands = app.enabledCommands[:len(app.enabledCommands)-1]
-			app.cursor += cursorModifier
-			return
-		}
+	ctx, cancel := context.WithTimeout(context.Background(), VERSION_TIMEOUT)
+	defer cancel()
 
-		i++
+	// Some commands exit with an error after printing their version
+	output, err := exec.CommandContext(ctx, command[0], command[1:]...).CombinedOutput()
+	if err != nil && len(output) == 0 {
+		return sp.Command.Version, fmt.Errorf("unable to run version command: %w", err)
+	}
 
-		for j := range cmd.optValues {
-			if i == deleteAt {
-				cmd.deleteOptionValueAt(j)
-				app.cursor += cursorModifier
-				return
-			}
-			i++
-		}
+	match := re.FindSubmatch(output)
+	if match == nil {
+		return sp.Command.Version, fmt.Errorf("version not found in the output of: %v", strings.Join(command, " "))
+	} else if len(match) > 1 {
+		return string(match[1]), nil
 	}
+	return string(match[0]), nil
 }
 
-func (app *application) handlePrefixKey(key rune) {
-	found := false
-	for _, cmd := range app.enabledCommands {
-		for _, opt := range cmd.Options {
-			if opt.prefix == key {
-				found = true
-				break
-			}
-		}
-
-		if found {
-			break
-		}
+// specSearchPath returns the directories where specs are looked up by
+// command name. It can be set with the BRIEF_PATH environment variable,
+// otherwise the brief directory in the user's config directory is used.
+func specSearchPath() []string {
+	env := os.Getenv(SPEC_PATH_ENV)
+	if env != "" {
+		return filepath.SplitList(env)
 	}
 
-	if app.lastPrefix != key {
-		if found {
-			app.showMessage(string(key))
-			app.lastPrefix = key
-		} else {
-			app.showMessage("%c is undefined", key)
-			app.lastPrefix = 0
-		}
-	} else {
-		app.showMessage("")
-		app.lastPrefix = 0
+	dir := configDir()
+	if dir == "" {
+		return nil
 	}
+	return []string{dir}
 }
 
-func (app *application) handleEnvvarKey() {
-	if app.lastPrefix != 0 {
-		app.showMessage("%c%c is undefined", app.lastPrefix, ENVVAR_KEY)
-		app.lastPrefix = 0
-		return
+// findSpec returns the path of the spec file for name. The name can
+// either be a path to a spec file, or a command name (e.g. "docker")
+// whose spec will be looked up in the spec search path.
+func findSpec(name string) (string, error) {
+	if info, err := os.Stat(name); err == nil && !info.IsDir() {
+		return name, nil
 	}
 
-	completions := []string{}
-	for _, val := range os.Environ() {
-		parts := strings.Split(val, "=")
-		completions = append(completions, parts[0]+"=")
+	for _, dir := range specSearchPath() {
+		path := filepath.Join(dir, name+SPEC_EXTENSION)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
 	}
-	sort.Strings(completions)
 
-	app.minibufferRead("value:", func(ok bool, val string) {
-		if ok {
-			parts := strings.Split(val, "=")
-			if len(parts) == 1 || len(parts[0]) == 0 {
-				app.showMessage("invalid environment variable format")
-				return
-			}
-			app.environment = append(app.environment, val)
-			app.cursor++
-		}
-	}, "", "VAR=VAL", completions)
+	return "", fmt.Errorf("command file not found: %v", name)
 }
 
-func (app *application) handleLetterKeyNoPrefix(key rune) {
-	found := false
-	for _, cmd := range app.visibleCommands() {
-		if cmd.key == key {
-			app.enabledCommands = append(app.enabledCommands, cmd)
-			app.cursor = math.MaxInt
-			found = true
-			break
-		}
+func loadSpec(path string) (*spec, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("command file not found: %v", path)
 	}
 
-	if !found {
-		app.showMessage("%c is undefined", key)
+	var sp spec
+	err = yaml.Unmarshal(data, &sp)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal YAML data: %w", err)
 	}
-}
 
-func (app *application) handleDigitKeyNoPrefix(key rune) {
-	found := false
+	err = checkSpecVersion(sp.Version)
+	if err != nil {
+		return nil, err
+	}
 
-	for _, cmd := range app.enabledCommands {
-		for _, opt := range cmd.Options {
-			if !opt.isArgument() {
-				continue
-			}
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("unable to unmarshal YAML data: %w", err)
+	}
 
-			if opt.key == key {
-				if !cmd.isOptionEnabled(opt) || opt.Repeatable {
-					app.promptOptionValue(cmd, opt)
-				} else {
-					cmd.deleteOptionValuesFor(opt)
-				}
-				found = true
-				break
+	if len(doc.Content) > 0 {
+		root := resolveAlias(doc.Content[0])
+		sp.Extensions = nodeExtensions(root)
+		if node := mappingValue(root, "command"); node != nil {
+			sp.Command.Extensions, err = readExtensions(node, sp.Command.Options, sp.Command.Subcommands)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read extensions: %w", err)
 			}
 		}
+	}
 
-		if found {
-			break
+	err = applyExtensions(sp.Command.Name, sp.Command.Extensions, &sp.Command.Groups, sp.Command.Options, sp.Command.Subcommands)
+	if err != nil {
+		return nil, err
+	}
+
+	if compareVersions(sp.Version, SPEC_VERSION) > 0 {
+		warning := fmt.Sprintf("spec version %v is newer than %v, some features may be ignored", sp.Version, SPEC_VERSION)
+		if unknown := unknownFields(data); len(unknown) > 0 {
+			warning += " (" + strings.Join(unknown, ", ") + ")"
 		}
+		sp.warnings = append(sp.warnings, warning)
 	}
 
-	if !found {
-		app.showMessage("%c is undefined", key)
+	err = checkGroups(sp.Command.Name, sp.Command.Groups, sp.Command.Options, sp.Command.Subcommands)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func (app *application) promptOptionValue(cmd *subcommand, opt *option) {
-	var completion []string
+	return &sp, nil
+}
 
-	if len(opt.Completion.Values) > 0 {
-		completion = opt.Completion.Values
+// resolveAlias returns the node an alias points to, or the node itself
+// if it isn't an alias.
+func resolveAlias(node *yaml.Node) *yaml.Node {
+	if node.Kind == yaml.AliasNode {
+		return node.Alias
 	}
+	return node
+}
 
-	if opt.isFlag() && opt.isTemplate() {
-		// Handle flags like --validate-<thing> (template)
-		app.minibufferRead("flag:", func(ok bool, val string) {
-			if !ok || !strings.HasPrefix(val, "-") {
-				return
-			}
-
-			app.minibufferRead("value:", func(ok bool, val2 string) {
-				if ok {
-					app.addOptionValue(cmd, opt, val2, val)
-				}
-			}, opt.Default, opt.Placeholder, completion)
+// nodeExtensions returns the x- properties of a mapping node.
+func nodeExtensions(node *yaml.Node) extensions {
+	ext := extensions{}
+	if node.Kind != yaml.MappingNode {
+		return ext
+	}
 
-		}, opt.longFlag(), "", nil)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i].Value
+		if !strings.HasPrefix(key, EXTENSION_PREFIX) {
+			continue
+		}
 
-		return
+		var value any
+		if node.Content[i+1].Decode(&value) == nil {
+			ext[key] = value
+		}
 	}
+	return ext
+}
 
-	app.minibufferRead("value:", func(ok bool, val string) {
-		if ok {
-			app.addOptionValue(cmd, opt, val, "")
+// readExtensions stores the x- properties of the options and subcommands
+// of a command node in their Extensions, and returns the command's own.
+// The options and subcommands must have been decoded from node, so that
+// they are matched with their nodes by position.
+func readExtensions(node *yaml.Node, options []*option, subcommands []*subcommand) (extensions, error) {
+	node = resolveAlias(node)
+	if seq := mappingValue(node, "options"); seq != nil {
+		seq = resolveAlias(seq)
+		if len(seq.Content) != len(options) {
+			return nil, fmt.Errorf("line %v: options don't match the decoded ones", seq.Line)
 		}
-	}, opt.Default, opt.Placeholder, completion)
-}
 
-func (app *application) addOptionValue(cmd *subcommand, opt *option, val string, flag string) {
-	cmd.optValues = append(cmd.optValues, &optionValue{opt: opt, value: val, flag: flag})
-	app.cursor = app.cursorMax + 1
-}
+		for i, item := range seq.Content {
+			options[i].Extensions = nodeExtensions(resolveAlias(item))
+		}
+	}
 
-func (app *application) handleLetterDigitKeyWithPrefix(key rune) {
-	found := false
+	if seq := mappingValue(node, "subcommands"); seq != nil {
+		seq = resolveAlias(seq)
+		if len(seq.Content) != len(subcommands) {
+			return nil, fmt.Errorf("line %v: subcommands don't match the decoded ones", seq.Line)
+		}
 
-	for _, cmd := range app.enabledCommands {
-		for _, opt := range cmd.Options {
-			if !opt.isFlag() {
-				continue
+		for i, item := range seq.Content {
+			cmd := subcommands[i]
+			ext, err := readExtensions(item, cmd.Options, cmd.Subcommands)
+			if err != nil {
+				return nil, err
 			}
+			cmd.Extensions = ext
+		}
+	}
 
-			if opt.prefix == app.lastPrefix && opt.key == key {
-				if opt.Repeatable {
-					app.promptOptionValue(cmd, opt)
-				} else {
-					if !cmd.isOptionEnabled(opt) {
-						if opt.getType() == FLAG_TYPE_TOGGLE {
-							app.addOptionValue(cmd, opt, "", "")
-						} else {
-							app.promptOptionValue(cmd, opt)
-						}
-					} else {
-						cmd.deleteOptionValuesFor(opt)
-					}
-				}
+	return nodeExtensions(node), nil
+}
 
-				found = true
-				break
-			}
+// applyExtensions reads brief's hints from the x-brief- properties of a
+// command, its options and subcommands.
+func applyExtensions(name string, ext extensions, groups *[]*group, options []*option, subcommands []*subcommand) error {
+	if value, found := ext[BRIEF_EXTENSION_PREFIX+"groups"]; found {
+		data, err := yaml.Marshal(value)
+		if err != nil {
+			return err
 		}
 
-		if found {
-			break
+		extra := []*group{}
+		err = yaml.Unmarshal(data, &extra)
+		if err != nil {
+			return fmt.Errorf("invalid %vgroups in %v: %w", BRIEF_EXTENSION_PREFIX, name, err)
 		}
+		*groups = append(*groups, extra...)
 	}
 
-	if !found {
-		app.showMessage("%c%c is undefined", app.lastPrefix, key)
+	for _, opt := range options {
+		if opt.Group == "" {
+			opt.Group = opt.Extensions.brief("group")
+		}
 	}
-}
 
-func (app *application) handleLetterDigitKey(key rune) {
-	if app.lastPrefix == 0 {
-		if strings.ContainsRune(LETTERS, key) {
-			app.handleLetterKeyNoPrefix(key)
-		} else {
-			app.handleDigitKeyNoPrefix(key)
+	for _, cmd := range subcommands {
+		err := applyExtensions(name+" "+cmd.Name, cmd.Extensions, &cmd.Groups, cmd.Options, cmd.Subcommands)
+		if err != nil {
+			return err
 		}
-	} else {
-		app.handleLetterDigitKeyWithPrefix(key)
 	}
-	app.lastPrefix = 0
+
+	return nil
 }
 
-func (app *application) handlePrintableKey(key rune) {
-	if isPrefix(key) {
-		app.handlePrefixKey(key)
-	} else if key == ENVVAR_KEY {
-		app.handleEnvvarKey()
-	} else if strings.ContainsRune(LETTERS+DIGITS, key) {
-		app.handleLetterDigitKey(key)
-	} else if key == HELP_KEY {
-		app.handleHelpKey()
-	} else {
-		app.showMessage("%c is undefined", key)
+// checkSpecVersion checks that a spec version is compatible with the
+// supported one, i.e. that it has the same major version. Newer minor
+// versions are accepted, ignoring the features brief doesn't know about.
+func checkSpecVersion(version string) error {
+	numbers, supported := parseVersion(version), parseVersion(SPEC_VERSION)
+	if len(numbers) == 0 || numbers[0] != supported[0] {
+		return fmt.Errorf("spec version %v is not supported, it must be %v.x", version, supported[0])
 	}
+	return nil
 }
 
-func (app *application) handlePagination(up bool) {
-	front, _ := app.ui.optionsPages.GetFrontPage()
-	count := app.ui.optionsPages.GetPageCount()
+// unknownFields returns the fields in a spec which brief doesn't know
+// about, with the lines they are in. Extensions are not included.
+func unknownFields(data []byte) []string {
+	var sp spec
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
 
-	index, _ := strconv.Atoi(front)
-	if up {
-		index--
-	} else {
-		index++
+	var typeErr *yaml.TypeError
+	if !errors.As(decoder.Decode(&sp), &typeErr) {
+		return nil
 	}
 
-	if index < 0 {
-		index = 0
-	} else if index > count-1 {
-		index = count - 1
+	re := regexp.MustCompile(`^(line \d+): field (\S+) not found in type .*$`)
+	fields := []string{}
+	for _, e := range typeErr.Errors {
+		if match := re.FindStringSubmatch(e); match != nil && strings.HasPrefix(match[2], EXTENSION_PREFIX) {
+			continue
+		}
+		fields = append(fields, re.ReplaceAllString(e, "$1: unknown field $2"))
 	}
-
-	app.ui.optionsPages.SwitchToPage(strconv.Itoa(index))
+	return fields
 }
 
-func (app *application) handleHelpKey() {
-	// Allow using the help key even if a prefix key was active,
-	// for convenience.
-	app.lastPrefix = 0
-	app.helpActive = true
-	app.ui.root.AddItem(app.ui.helpModal, 0, 0, true)
+// migration updates a spec to version to. Specs are only changed in
+// ways that keep their comments and formatting as much as possible.
+type migration struct {
+	to string
+	// Changes to the spec's document, if any, other than the version
+	apply func(root *yaml.Node) error
 }
 
-func (app *application) handleHelpClose() {
-	app.ui.root.RemoveItem(app.ui.helpModal)
-	app.helpActive = false
-	app.tviewApp.SetFocus(app.ui.root)
+func specMigrations() []migration {
+	return []migration{
+		// Version 1.1.0 only added new properties
+		{to: "1.1.0"},
+	}
 }
 
-func (app *application) handleFinishEditing() {
-	command := app.currentCommand()
-	fmt.Println(command)
+// mappingValue returns the value for key in a YAML mapping node, or nil
+// if it is not present.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
 
-	if !clipboard.Unsupported {
-		clipboard.WriteAll(command)
-		fmt.Println("(copied to clipboard)")
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
 	}
+	return nil
 }
 
-func (app *application) initialize() {
-	app.initialized = true
-	app.showMessage("press %c for help, Ctrl-C to exit, ENTER to finish editing", HELP_KEY)
-}
+// migrateSpec rewrites the spec at path in the current spec version,
+// keeping its comments. It returns the version the spec had.
+func migrateSpec(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("command file not found: %v", path)
+	}
 
-func (app *application) captureRootInput(event *tcell.EventKey) *tcell.EventKey {
-	if app.minibufferActive {
-		return event
-	} else if app.helpActive {
-		app.handleHelpClose()
-		return nil
+	var doc yaml.Node
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return "", fmt.Errorf("unable to unmarshal YAML data: %w", err)
 	}
 
-	app.showMessage("")
+	if doc.Kind != yaml.DocumentNode || len(doc.Content) == 0 {
+		return "", fmt.Errorf("%v is not a spec", path)
+	}
 
-	switch key := event.Key(); key {
-	case CANCEL_KEY:
-		app.lastPrefix = 0
-	case tcell.KeyBackspace:
-		fallthrough
-	case tcell.KeyBackspace2:
-		fallthrough
-	case tcell.KeyDelete:
-		app.handleDeletionKey(key != tcell.KeyDelete)
-	case tcell.KeyEnter:
-		app.onCloseCallback = app.handleFinishEditing
-		app.tviewApp.Stop()
-	case tcell.KeyLeft:
-		app.cursor--
-	case tcell.KeyRight:
-		app.cursor++
-	case tcell.KeyUp:
-		fallthrough
-	case tcell.KeyDown:
-		app.handlePagination(key == tcell.KeyUp)
-	case tcell.KeyRune:
-		app.handlePrintableKey(event.Rune())
+	root := doc.Content[0]
+	versionNode := mappingValue(root, "specVersion")
+	if versionNode == nil {
+		return "", fmt.Errorf("%v has no specVersion", path)
 	}
 
-	app.clampCursor()
-	app.updateKeys()
-	app.updateViews()
+	version := versionNode.Value
+	err = checkSpecVersion(version)
+	if err != nil {
+		return "", err
+	}
 
-	if !app.initialized {
-		app.initialize()
+	if compareVersions(version, SPEC_VERSION) >= 0 {
+		return version, nil
 	}
 
-	return nil
+	for _, m := range specMigrations() {
+		if compareVersions(version, m.to) >= 0 || m.apply == nil {
+			continue
+		}
+
+		err = m.apply(root)
+		if err != nil {
+			return "", fmt.Errorf("unable to migrate to %v: %w", m.to, err)
+		}
+	}
+	versionNode.Value = SPEC_VERSION
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&doc)
+	if err != nil {
+		return "", fmt.Errorf("unable to marshal YAML data: %w", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	return version, os.WriteFile(path, buf.Bytes(), info.Mode())
 }
 
-func (app *application) clampCursor() {
-	app.cursorMax = len(app.environment)
-	app.cursorMax += len(app.enabledCommands)
-	for _, cmd := range app.enabledCommands {
-		app.cursorMax += len(cmd.optValues)
+// runMigrate migrates every spec in paths to the current version.
+func runMigrate(paths []string) error {
+	if len(paths) == 0 {
+		return errors.New("a command file to migrate is required")
 	}
 
-	if app.cursor > app.cursorMax {
-		app.cursor = app.cursorMax
-	} else if app.cursor < 0 {
-		app.cursor = 0
+	for _, path := range paths {
+		version, err := migrateSpec(path)
+		if err != nil {
+			return fmt.Errorf("%v: %w", path, err)
+		}
+
+		if compareVersions(version, SPEC_VERSION) >= 0 {
+			fmt.Printf("%v: already at version %v\n", path, version)
+		} else {
+			fmt.Printf("%v: migrated from version %v to %v\n", path, version, SPEC_VERSION)
+		}
 	}
+	return nil
 }
 
-func (app *application) captureMinibufferInput(event *tcell.EventKey) *tcell.EventKey {
-	if event.Key() == CANCEL_KEY {
-		return tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone)
+// checkGroups checks that options only refer to groups declared by their
+// command, and that menu keys are valid, for a command and all its
+// subcommands.
+func checkGroups(name string, groups []*group, options []*option, subcommands []*subcommand) error {
+	keys := make(map[string]struct{})
+	for _, g := range groups {
+		if !g.isMenu() {
+			continue
+		}
+
+		_, used := keys[g.Key]
+		if len([]rune(g.Key)) != 1 || !strings.Contains(LETTERS, g.Key) || used {
+			return fmt.Errorf("menu %v of %v must have a unique, single letter key", g.Name, name)
+		}
+		keys[g.Key] = struct{}{}
 	}
-	return event
+
+	flags := make(map[string]int)
+	for _, opt := range options {
+		if opt.Group == "" {
+			continue
+		}
+
+		var found *group
+		for _, g := range groups {
+			if g.Name == opt.Group {
+				found = g
+				break
+			}
+		}
+
+		if found == nil {
+			return fmt.Errorf("option %v of %v refers to undeclared group: %v", opt.name(), name, opt.Group)
+		}
+
+		if opt.isFlag() && found.isMenu() {
+			// Flags in menus are activated with a single letter
+			flags[found.Name]++
+			if flags[found.Name] > len(LETTERS) {
+				return fmt.Errorf("menu %v of %v has more than %v flags", found.Name, name, len(LETTERS))
+			}
+		}
+	}
+
+	for _, cmd := range subcommands {
+		err := checkGroups(name+" "+cmd.Name, cmd.Groups, cmd.Options, cmd.Subcommands)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: %v [flags] <command file or name> [subcommand...]\n", os.Args[0])
+		fmt.Fprintf(flag.CommandLine.Output(), "       %v %v <command file>...\n", os.Args[0], MIGRATE_COMMAND)
+		fmt.Fprintf(flag.CommandLine.Output(), "       (if a command file called %v exists, it is opened instead)\n", MIGRATE_COMMAND)
+		flag.PrintDefaults()
+	}
+	targetVersion := flag.String("target-version", "", "version of the command to build for (by default, it is detected if the spec allows it, or taken from the spec)")
 	flag.Parse()
 
-	if flag.NArg() != 1 {
+	if flag.NArg() < 1 {
 		fmt.Fprintln(os.Stderr, "error: a command file is required")
 		flag.Usage()
 		os.Exit(1)
 	}
 
-	data, err := os.ReadFile(flag.Arg(0))
+	// A command file for a tool called migrate takes precedence, so
+	// that it can still be opened.
+	if _, err := findSpec(flag.Arg(0)); err != nil && flag.Arg(0) == MIGRATE_COMMAND {
+		err := runMigrate(flag.Args()[1:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	path, err := findSpec(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+
+	sp, err := loadSpec(path)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error: command file not found:", flag.Arg(0))
+		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
 
-	var sp spec
-	err = yaml.Unmarshal(data, &sp)
+	cfg, err := loadConfig()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error: unable to unmarshal YAML data:", err)
+		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
 
-	if sp.Version != SPEC_VERSION {
-		fmt.Fprintln(os.Stderr, "error: spec version must match", SPEC_VERSION)
+	version := *targetVersion
+	if version == "" {
+		version, err = detectVersion(sp, path, true)
+		if err != nil {
+			// Continue with the spec's version instead
+			fmt.Fprintln(os.Stderr, "warning:", err)
+		}
+	}
+
+	app := newApplication(sp, cfg, tview.NewApplication())
+	app.version = version
+
+	err = app.enableCommandPath(flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
 		os.Exit(1)
 	}
 
-	app := newApplication(&sp)
-	// Queue a key-press event so that captureRootInput is called immediately
-	// after tview has finished setting up the application. This in turn allows
-	// brief to do some further initialization (e.g. updating views for the first
-	// time).
-	app.tviewApp.QueueEvent(tcell.NewEventKey(CANCEL_KEY, 0, tcell.ModNone))
+	app.show()
 
 	if err := app.tviewApp.Run(); err != nil {
 		panic(err)
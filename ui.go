@@ -8,14 +8,19 @@ import (
 )
 
 type userInterface struct {
-	cmdPreviewTextView  *tview.TextView
-	subcommandsTextView *tview.TextView
-	optionsPages        *tview.Pages
-	optionsFlex         *tview.Flex
-	minibuffer          *tview.InputField
-	messagesTextView    *tview.TextView
-	helpModal           *tview.Modal
-	root                *tview.Flex
+	cmdPreviewTextView *tview.TextView
+	subcommandsPages   *tview.Pages
+	subcommandsFlex    *tview.Flex
+	optionsPages       *tview.Pages
+	optionsFlex        *tview.Flex
+	bottomFlex         *tview.Flex
+	detailsFlex        *tview.Flex
+	detailsTextView    *tview.TextView
+	detailsShown       bool
+	minibuffer         *tview.InputField
+	messagesTextView   *tview.TextView
+	helpModal          *tview.Modal
+	root               *tview.Flex
 }
 
 type uiText struct {
@@ -36,7 +41,7 @@ Subcommands (when present), are shown on the 'Subcommands' panel. Activate subco
 f  foo
 b  bar
 
-then the 'f' key would activate the foo subcommand, and 'b' would activate the bar subcommand.
+then the 'f' key would activate the foo subcommand, and 'b' would activate the bar subcommand. Press Ctrl-S to search subcommands by name, alias or help text, and use the arrow keys to pick one. When there are too many subcommands to fit, use PAGE UP and PAGE DOWN to move through the pages of the 'Subcommands' panel (the up and down arrow keys do the same for the 'Options' panel).
 
 Options (i.e. flags and positional arguments) are shown on the 'Options' panel. Activate flags by first pressing the corresponding prefix key ('-', '=' or '+') and letter. For example, given:
 
@@ -45,8 +50,24 @@ Options (i.e. flags and positional arguments) are shown on the 'Options' panel.
 
 Then pressing '-' followed by 't' would enable the --test flag. Pressing '=' followed by 'v' would enable the --version flag.
 
+Flags of the count type (like -vvv) are incremented every time their key is pressed. Press '_' before an option's keys to decrement it instead (or to disable any other type of option).
+
+Press '!' to set an environment variable for the command (or to unset it with env -u, by prefixing its name with '-'). Variables declared by the command are listed with their own keys after '!', and '!!' sets any other variable.
+
+Wrapper commands like sudo or time are toggled in front of the command with '^' followed by their letter.
+
+Options can be organized in groups. Press '#' followed by a group's key to collapse or expand it. Groups marked as menus are opened with their key, and their options are then activated with a single key. Press ESC or Ctrl-G to leave a menu.
+
+Press Ctrl-T to show hidden subcommands and options as well.
+
+Press '/' to filter the options by their flags, metavar or help text, and select one to activate it.
+
 Positional arguments are enabled by pressing their corresponding number key ('0', '9', etc).
 
+Move through the command's components with the left and right arrow keys. Press DEL or BACKSPACE to delete a component, and Ctrl-E to edit its value without changing its position. The 'Details' panel shows everything known about the component under the cursor. New values are inserted at the cursor, and Shift-Left/Shift-Right move the value under the cursor.
+
+Options marked as [required] must be present before finishing. Press TAB to be prompted for every missing value in turn.
+
 Finally, press ENTER to finish building the command and copy it to the keyboard. Press Ctrl-C to close brief.
 
 More information available at:
@@ -89,6 +110,16 @@ func (txt *uiText) nl() *uiText {
 	return txt
 }
 
+// keepTogether moves on to the next page if the next n lines don't fit
+// in the current one, but would fit in an empty page.
+func (txt *uiText) keepTogether(n int) *uiText {
+	if txt.paginated && txt.currentHeight > 1 && txt.currentHeight+n-1 > txt.maxHeight && n <= txt.maxHeight {
+		txt.i++
+		txt.currentHeight = 0
+	}
+	return txt
+}
+
 func (txt *uiText) pagesCount() int {
 	return len(txt.builders)
 }
@@ -153,6 +184,14 @@ func (txt *uiText) noitalic() *uiText {
 	return txt.removeFlag('i')
 }
 
+func (txt *uiText) strike() *uiText {
+	return txt.applyFlag('s')
+}
+
+func (txt *uiText) nostrike() *uiText {
+	return txt.removeFlag('s')
+}
+
 func (txt *uiText) color(c string) *uiText {
 	txt.color_ = c
 	txt.writeFlags()
@@ -164,7 +203,23 @@ func (txt *uiText) nocolor() *uiText {
 }
 
 func (txt *uiText) reset() *uiText {
-	return txt.undim().unbold().noitalic().nocolor()
+	return txt.undim().unbold().noitalic().nostrike().nocolor()
+}
+
+// field writes a "name: value" line, unless value is empty.
+func (txt *uiText) field(name string, value string) *uiText {
+	if value == "" {
+		return txt
+	}
+	return txt.dim().write(name + ": ").undim().write(tview.Escape(value)).nl()
+}
+
+// paragraph writes s after an empty line, unless s is empty.
+func (txt *uiText) paragraph(s string) *uiText {
+	if s == "" {
+		return txt
+	}
+	return txt.nl().write(tview.Escape(strings.TrimSpace(s))).nl()
 }
 
 func regionInt(id int, contents string) string {
@@ -196,10 +251,8 @@ func newUserInterface(subcommandsEnabled bool) *userInterface {
 	subcommandsFlex.SetTitle("Subcommands")
 	subcommandsFlex.SetTitleAlign(tview.AlignLeft)
 
-	subcommandsTextView := tview.NewTextView()
-	subcommandsTextView.SetDynamicColors(true)
-
-	subcommandsFlex.AddItem(subcommandsTextView, 0, 1, false)
+	subcommandsPages := tview.NewPages()
+	subcommandsFlex.AddItem(subcommandsPages, 0, 1, false)
 
 	optionsFlex := tview.NewFlex()
 	optionsFlex.SetBorder(true)
@@ -209,6 +262,17 @@ func newUserInterface(subcommandsEnabled bool) *userInterface {
 	optionsPages := tview.NewPages()
 	optionsFlex.AddItem(optionsPages, 0, 1, false)
 
+	detailsFlex := tview.NewFlex()
+	detailsFlex.SetBorder(true)
+	detailsFlex.SetTitle("Details")
+	detailsFlex.SetTitleAlign(tview.AlignLeft)
+
+	detailsTextView := tview.NewTextView()
+	detailsTextView.SetDynamicColors(true)
+	detailsTextView.SetWordWrap(true)
+
+	detailsFlex.AddItem(detailsTextView, 0, 1, false)
+
 	bottomFlex := tview.NewFlex()
 
 	if subcommandsEnabled {
@@ -230,13 +294,32 @@ func newUserInterface(subcommandsEnabled bool) *userInterface {
 	helpModal.SetText(HELP_TEXT)
 
 	return &userInterface{
-		root:                root,
-		cmdPreviewTextView:  cmdPreviewTextView,
-		subcommandsTextView: subcommandsTextView,
-		optionsPages:        optionsPages,
-		optionsFlex:         optionsFlex,
-		minibuffer:          minibuffer,
-		messagesTextView:    messagesTextView,
-		helpModal:           helpModal,
+		root:               root,
+		cmdPreviewTextView: cmdPreviewTextView,
+		subcommandsPages:   subcommandsPages,
+		subcommandsFlex:    subcommandsFlex,
+		optionsPages:       optionsPages,
+		optionsFlex:        optionsFlex,
+		bottomFlex:         bottomFlex,
+		detailsFlex:        detailsFlex,
+		detailsTextView:    detailsTextView,
+		minibuffer:         minibuffer,
+		messagesTextView:   messagesTextView,
+		helpModal:          helpModal,
+	}
+}
+
+// showDetails shows or hides the panel with the details of the component
+// under the cursor.
+func (ui *userInterface) showDetails(show bool) {
+	if show == ui.detailsShown {
+		return
+	}
+
+	if show {
+		ui.bottomFlex.AddItem(ui.detailsFlex, 0, 1, false)
+	} else {
+		ui.bottomFlex.RemoveItem(ui.detailsFlex)
 	}
+	ui.detailsShown = show
 }